@@ -0,0 +1,16 @@
+package main
+
+import (
+	"crypto/subtle"
+	"os"
+)
+
+// authSecret is required from callers when AUTH_SECRET is set, either in the
+// X-Tweakle-Secret header or as "secret" in the user_defined_context of the
+// remote function. The header, when present, is checked before the body is
+// read, and the user_defined_context is used only without it.
+var authSecret = os.Getenv("AUTH_SECRET")
+
+func authorized(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(authSecret)) == 1
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// extractionCache keeps extracted bodies in memory for CACHE_TTL so that
+// repeated extractions of the same request reuse them. At most
+// CACHE_MAX_BYTES (default 64MiB) are kept, evicting the oldest entries.
+// Nothing is cached when CACHE_TTL is unset.
+type extractionCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	maxBytes int64
+	size     int64
+	entries  map[string]*cacheEntry
+	// keys are in insertion order, oldest first.
+	keys []string
+}
+
+type cacheEntry struct {
+	body     []byte
+	metadata Metadata
+	expires  time.Time
+}
+
+var cache = newExtractionCache()
+
+func newExtractionCache() *extractionCache {
+	c := &extractionCache{maxBytes: int64(newLimit("CACHE_MAX_BYTES", 64<<20)), entries: map[string]*cacheEntry{}}
+	if v := os.Getenv("CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid CACHE_TTL: %v", err)
+		}
+		c.ttl = d
+	}
+	return c
+}
+
+// cacheKey identifies the extraction by everything that affects the body,
+// including the credentials so that callers never share each other's data.
+func (e *HTTPExtractor) cacheKey() string {
+	b, _ := json.Marshal([]any{e.method, e.url, e.body, e.headers, e.oauth2, e.sftp, e.mirrors, e.maxBytes, e.headBytes, e.pages, e.contentType, e.tls})
+	return string(b)
+}
+
+func (c *extractionCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry, true
+}
+
+func (c *extractionCache) put(key string, body []byte, metadata Metadata) {
+	if int64(len(body)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[key]; ok {
+		c.size -= int64(len(old.body))
+		c.remove(key)
+	}
+	for len(c.keys) > 0 && (c.size+int64(len(body)) > c.maxBytes || time.Now().After(c.entries[c.keys[0]].expires)) {
+		c.size -= int64(len(c.entries[c.keys[0]].body))
+		delete(c.entries, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+	c.entries[key] = &cacheEntry{body, metadata, time.Now().Add(c.ttl)}
+	c.keys = append(c.keys, key)
+	c.size += int64(len(body))
+}
+
+func (c *extractionCache) remove(key string) {
+	delete(c.entries, key)
+	for i, k := range c.keys {
+		if k == key {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+// errorStatus maps the stage an error occurred in to the HTTP status code of
+// the response. Entries can be overridden as a JSON object in ERROR_STATUS,
+// e.g. {"extract": 503}.
+var errorStatus = newErrorStatus()
+
+func newErrorStatus() map[string]int {
+	m := map[string]int{
+		"auth":    http.StatusUnauthorized,
+		"request": http.StatusBadRequest,
+		// parse stays 502 as before ERROR_STATUS, for callers retrying on 5xx.
+		"parse":   http.StatusBadGateway,
+		"extract": http.StatusBadGateway,
+		"tweak":   http.StatusBadGateway,
+		"load":    http.StatusBadGateway,
+		// unavailable is an extraction short-circuited by an open breaker.
+		"unavailable": http.StatusServiceUnavailable,
+	}
+	if v := os.Getenv("ERROR_STATUS"); v != "" {
+		var override map[string]int
+		if err := json.Unmarshal([]byte(v), &override); err != nil {
+			log.Fatalf("invalid ERROR_STATUS: %v", err)
+		}
+		for k, v := range override {
+			if _, ok := m[k]; !ok {
+				log.Fatalf("invalid ERROR_STATUS: unknown stage %q", k)
+			}
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// ERROR_FORMAT selects the error payload: "default" returns
+// {"errorMessage": ...} as BigQuery expects, and "structured" returns
+// {"error": {"stage": ..., "message": ...}}. With ERROR_VERBOSITY=stage only
+// the stage is reported, hiding details such as upstream URLs.
+var (
+	errorFormat    = os.Getenv("ERROR_FORMAT")
+	errorVerbosity = os.Getenv("ERROR_VERBOSITY")
+)
+
+func init() {
+	switch errorFormat {
+	case "", "default", "structured":
+	default:
+		log.Fatalf("invalid ERROR_FORMAT: %q", errorFormat)
+	}
+	switch errorVerbosity {
+	case "", "message", "stage":
+	default:
+		log.Fatalf("invalid ERROR_VERBOSITY: %q", errorVerbosity)
+	}
+}
+
+func returnError(w http.ResponseWriter, stage string, err error) {
+	log.Printf("%s: %v", stage, err)
+	message := err.Error()
+	if errorVerbosity == "stage" {
+		message = fmt.Sprintf("%s failed", stage)
+	}
+
+	var payload any = map[string]string{"errorMessage": message}
+	if errorFormat == "structured" {
+		e := map[string]string{"stage": stage}
+		if errorVerbosity != "stage" {
+			e["message"] = message
+		}
+		payload = map[string]any{"error": e}
+	}
+
+	data, err := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(errorStatus[stage])
+	if err != nil {
+		fmt.Fprint(w, `{"errorMessage": "json.Marshal Failed"}`)
+		return
+	}
+	w.Write(data)
+}
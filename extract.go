@@ -0,0 +1,765 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cloud.google.com/go/storage"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/secretmanager/v1"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// hostLimiters rate limits outbound requests per host. The limit is read from
+// RATE_LIMIT (requests per second) and RATE_BURST; requests are not limited
+// when RATE_LIMIT is unset.
+type hostLimiters struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*rate.Limiter
+}
+
+var limiters = newHostLimiters()
+
+func newHostLimiters() *hostLimiters {
+	l := &hostLimiters{limit: rate.Inf, burst: 1, limiters: map[string]*rate.Limiter{}}
+	if v := os.Getenv("RATE_LIMIT"); v != "" {
+		limit, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Fatalf("invalid RATE_LIMIT: %v", err)
+		}
+		if !(limit >= 0) {
+			log.Fatalf("invalid RATE_LIMIT: %q", v)
+		}
+		// A zero limit would never refill the burst, so it means no limit.
+		if limit > 0 {
+			l.limit = rate.Limit(limit)
+		}
+	}
+	if v := os.Getenv("RATE_BURST"); v != "" {
+		burst, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid RATE_BURST: %v", err)
+		}
+		if burst <= 0 {
+			log.Fatalf("invalid RATE_BURST: %q", v)
+		}
+		l.burst = burst
+	}
+	return l
+}
+
+func (l *hostLimiters) get(host string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter, ok := l.limiters[host]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[host] = limiter
+	}
+	return limiter
+}
+
+// hostBreakers short-circuit extractions from a host after BREAKER_THRESHOLD
+// consecutive failures, until BREAKER_COOLDOWN (default 30s) has passed.
+// Only retryable errors count as failures, and a success resets the count.
+// Hosts are never short-circuited when BREAKER_THRESHOLD is unset.
+type hostBreakers struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	breakers  map[string]*breaker
+}
+
+type breaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+var errCircuitOpen = errors.New("circuit open")
+
+var breakers = newHostBreakers()
+
+func newHostBreakers() *hostBreakers {
+	b := &hostBreakers{cooldown: 30 * time.Second, breakers: map[string]*breaker{}}
+	if v := os.Getenv("BREAKER_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid BREAKER_THRESHOLD: %q", v)
+		}
+		b.threshold = n
+	}
+	if v := os.Getenv("BREAKER_COOLDOWN"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid BREAKER_COOLDOWN: %v", err)
+		}
+		b.cooldown = d
+	}
+	return b
+}
+
+// call runs f unless the breaker of host is open, and records its result.
+func (b *hostBreakers) call(host string, f func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if b.threshold == 0 {
+		return f()
+	}
+	b.mu.Lock()
+	br, ok := b.breakers[host]
+	if !ok {
+		br = &breaker{}
+		b.breakers[host] = br
+	}
+	if time.Now().Before(br.openUntil) {
+		until := br.openUntil
+		b.mu.Unlock()
+		return nil, fmt.Errorf("%s: %w until %s", host, errCircuitOpen, until.Format(time.RFC3339))
+	}
+	b.mu.Unlock()
+
+	r, err := f()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case err == nil:
+		br.failures = 0
+	case isRetryable(err):
+		br.failures++
+		if br.failures >= b.threshold {
+			log.Printf("circuit open for %s after %d failures", host, br.failures)
+			br.openUntil = time.Now().Add(b.cooldown)
+			br.failures = 0
+		}
+	}
+	return r, err
+}
+
+// httpClient is shared by all extractions so that connections are kept alive
+// and reused per host. The pool is tuned by MAX_IDLE_CONNS_PER_HOST and
+// IDLE_CONN_TIMEOUT, and TLS by TLS_MIN_VERSION and TLS_CIPHER_SUITES.
+var httpClient = &http.Client{Transport: newTransport()}
+
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = 16
+	if v := os.Getenv("MAX_IDLE_CONNS_PER_HOST"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid MAX_IDLE_CONNS_PER_HOST: %v", err)
+		}
+		t.MaxIdleConnsPerHost = n
+	}
+	if v := os.Getenv("IDLE_CONN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid IDLE_CONN_TIMEOUT: %v", err)
+		}
+		t.IdleConnTimeout = d
+	}
+	t.TLSClientConfig = newTLSConfig()
+	return t
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig never negotiates below TLS 1.2. Cipher suites are given by
+// name, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, and only apply up to
+// TLS 1.2 as TLS 1.3 suites are not configurable.
+func newTLSConfig() *tls.Config {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if v := os.Getenv("TLS_MIN_VERSION"); v != "" {
+		version, ok := tlsVersions[v]
+		if !ok {
+			log.Fatalf("invalid TLS_MIN_VERSION: %q", v)
+		}
+		c.MinVersion = version
+	}
+	if v := os.Getenv("TLS_CIPHER_SUITES"); v != "" {
+		suites := map[string]uint16{}
+		for _, s := range tls.CipherSuites() {
+			suites[s.Name] = s.ID
+		}
+		for _, name := range strings.Split(v, ",") {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				log.Fatalf("invalid TLS_CIPHER_SUITES: unknown or insecure suite %q", name)
+			}
+			c.CipherSuites = append(c.CipherSuites, id)
+		}
+	}
+	return c
+}
+
+// defaultHeaders are set on every extraction request unless overridden by
+// extraction.headers. They are read from DEFAULT_HEADERS as a JSON object, and
+// USER_AGENT sets the User-Agent.
+var defaultHeaders = newDefaultHeaders()
+
+func newDefaultHeaders() http.Header {
+	h := http.Header{}
+	if v := os.Getenv("DEFAULT_HEADERS"); v != "" {
+		var m map[string]string
+		if err := json.Unmarshal([]byte(v), &m); err != nil {
+			log.Fatalf("invalid DEFAULT_HEADERS: %v", err)
+		}
+		for k, v := range m {
+			h.Set(k, v)
+		}
+	}
+	if v := os.Getenv("USER_AGENT"); v != "" {
+		h.Set("User-Agent", v)
+	}
+	return h
+}
+
+type OAuth2 struct {
+	TokenURL     string   `json:"tokenUrl"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+}
+
+// tokenSources caches a token source per client so that a token is reused
+// until it expires.
+var tokenSources = struct {
+	sync.Mutex
+	m map[string]oauth2.TokenSource
+}{m: map[string]oauth2.TokenSource{}}
+
+func (o OAuth2) tokenSource() oauth2.TokenSource {
+	key := strings.Join(append([]string{o.TokenURL, o.ClientID, o.ClientSecret}, o.Scopes...), "\x00")
+	tokenSources.Lock()
+	defer tokenSources.Unlock()
+	ts, ok := tokenSources.m[key]
+	if !ok {
+		c := clientcredentials.Config{
+			ClientID:     o.ClientID,
+			ClientSecret: o.ClientSecret,
+			TokenURL:     o.TokenURL,
+			Scopes:       o.Scopes,
+		}
+		ts = c.TokenSource(context.Background())
+		tokenSources.m[key] = ts
+	}
+	return ts
+}
+
+// debugBytes is the number of bytes of extraction requests and responses to
+// log, read from DEBUG_BYTES. Nothing is logged when it is unset.
+var debugBytes = newDebugBytes()
+
+func newDebugBytes() int {
+	v := os.Getenv("DEBUG_BYTES")
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Fatalf("invalid DEBUG_BYTES: %q", v)
+	}
+	return n
+}
+
+func redact(h http.Header) http.Header {
+	h = h.Clone()
+	for k := range h {
+		if sensitiveHeader(k) {
+			h.Set(k, "REDACTED")
+		}
+	}
+	return h
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func debugRequest(req *http.Request, body string) {
+	if debugBytes == 0 {
+		return
+	}
+	log.Printf("debug: request: %s %s headers=%v body=%q", req.Method, req.URL, redact(req.Header), truncate(body, debugBytes))
+}
+
+// debugResponse logs the head of res.Body, leaving the body unread.
+func debugResponse(res *http.Response) {
+	if debugBytes == 0 {
+		return
+	}
+	br := bufio.NewReaderSize(res.Body, debugBytes)
+	b, _ := br.Peek(debugBytes)
+	log.Printf("debug: response: %s headers=%v body=%q", res.Status, redact(res.Header), b)
+	res.Body = ChainedCloser{br, res.Body}
+}
+
+type StatusError struct {
+	StatusCode int
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("Response failed with status code: %d\n", e.StatusCode)
+}
+
+// isRetryable reports whether err may succeed on another attempt or mirror:
+// network errors, 429 and 5xx responses, and open circuits.
+func isRetryable(err error) bool {
+	if errors.Is(err, errCircuitOpen) {
+		return true
+	}
+	var se StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode == http.StatusTooManyRequests || se.StatusCode >= 500
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// Metadata describes the response of an extraction request.
+type Metadata struct {
+	ContentLength int64
+	ContentType   string
+	LastModified  string
+	Header        http.Header
+}
+
+func newMetadata(res *http.Response) Metadata {
+	return Metadata{
+		ContentLength: res.ContentLength,
+		ContentType:   res.Header.Get("Content-Type"),
+		LastModified:  res.Header.Get("Last-Modified"),
+		Header:        res.Header,
+	}
+}
+
+// normalizeMethod trims and uppercases an HTTP method, defaulting to GET, so
+// that "get " works and a typo fails before any request is sent.
+func normalizeMethod(method string) (string, error) {
+	m := strings.ToUpper(strings.TrimSpace(method))
+	if m == "" {
+		return http.MethodGet, nil
+	}
+	for _, c := range m {
+		// The token characters of RFC 9110.
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return "", fmt.Errorf("invalid method: %q", method)
+		}
+	}
+	return m, nil
+}
+
+// sensitiveHeader reports whether a request or response header may carry
+// credentials.
+func sensitiveHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Set-Cookie", "Cookie", "Authorization", "Proxy-Authorization", "Www-Authenticate", "Proxy-Authenticate":
+		return true
+	}
+	name = strings.ToLower(name)
+	return strings.Contains(name, "token") || strings.Contains(name, "secret") || strings.Contains(name, "key")
+}
+
+// selectHeaders returns the named response headers, or all of them for "*",
+// with the values of sensitive ones replaced by REDACTED.
+func (m Metadata) selectHeaders(names []string) map[string]string {
+	selected := map[string]string{}
+	for _, name := range names {
+		if name == "*" {
+			for k := range m.Header {
+				selected[k] = ""
+			}
+			continue
+		}
+		if v := m.Header.Values(name); len(v) > 0 {
+			selected[http.CanonicalHeaderKey(name)] = ""
+		}
+	}
+	for k := range selected {
+		if sensitiveHeader(k) {
+			selected[k] = "REDACTED"
+		} else {
+			selected[k] = strings.Join(m.Header.Values(k), ", ")
+		}
+	}
+	return selected
+}
+
+// check rejects a response whose advertised length exceeds maxBytes.
+func (m Metadata) check(maxBytes int64) error {
+	if maxBytes > 0 && m.ContentLength > maxBytes {
+		return fmt.Errorf("content length %d exceeds maxBytes %d", m.ContentLength, maxBytes)
+	}
+	return nil
+}
+
+// MaxBytesReader fails once more than n bytes have been read, for responses
+// that do not advertise their length.
+type MaxBytesReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *MaxBytesReader) Read(p []byte) (int, error) {
+	if r.n < 0 {
+		return 0, fmt.Errorf("response exceeds maxBytes")
+	}
+	if int64(len(p)) > r.n+1 {
+		p = p[:r.n+1]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	if r.n < 0 {
+		return n + int(r.n), fmt.Errorf("response exceeds maxBytes")
+	}
+	return n, err
+}
+
+// GraphQL is a query sent as the standard GraphQL JSON POST body.
+type GraphQL struct {
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables,omitempty"`
+	OperationName string         `json:"operationName,omitempty"`
+}
+
+func (q GraphQL) body() (string, error) {
+	if q.Query == "" {
+		return "", fmt.Errorf("graphql: query is required")
+	}
+	b, err := json.Marshal(q)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// BodyTemplate is a request body kept apart from the call, such as a SOAP
+// envelope. The template at URL, http(s):// or gs:// in one of
+// templateBuckets, is executed by text/template with Params as the data.
+type BodyTemplate struct {
+	URL    string            `json:"url"`
+	Params map[string]string `json:"params"`
+}
+
+// templateBuckets are the buckets that bodyTemplate may read with the
+// service's credentials, read from BODY_TEMPLATE_BUCKETS separated by commas.
+// No gs:// template is read when it is unset.
+var templateBuckets = newAllowlist("BODY_TEMPLATE_BUCKETS")
+
+// newAllowlist reads the comma separated values of the environment variable.
+func newAllowlist(name string) map[string]bool {
+	allowed := map[string]bool{}
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			allowed[v] = true
+		}
+	}
+	return allowed
+}
+
+var bodyTemplateFuncs = template.FuncMap{
+	"xml": func(s string) (string, error) {
+		var b strings.Builder
+		err := xml.EscapeText(&b, []byte(s))
+		return b.String(), err
+	},
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func (t BodyTemplate) fetch() ([]byte, error) {
+	u, err := neturl.Parse(t.URL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "gs":
+		if !templateBuckets[u.Host] {
+			return nil, fmt.Errorf("bodyTemplate: bucket not in BODY_TEMPLATE_BUCKETS: %q", u.Host)
+		}
+		return readObject(u)
+	case "http", "https":
+		res, err := httpClient.Get(t.URL)
+		if err != nil {
+			log.Printf("http.Client.Get: %v", err)
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode > 299 {
+			return nil, StatusError{res.StatusCode}
+		}
+		return readAllLimited(res.Body)
+	default:
+		return nil, fmt.Errorf("bodyTemplate: unsupported url: %q", t.URL)
+	}
+}
+
+func (t BodyTemplate) render() (string, error) {
+	text, err := t.fetch()
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New(t.URL).Funcs(bodyTemplateFuncs).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return "", fmt.Errorf("bodyTemplate: %v", err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, t.Params); err != nil {
+		return "", fmt.Errorf("bodyTemplate: %v", err)
+	}
+	return b.String(), nil
+}
+
+// readObject reads a gs://bucket/object URL with the service's credentials.
+func readObject(u *neturl.URL) ([]byte, error) {
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		log.Printf("storage.NewClient: %v", err)
+		return nil, err
+	}
+	defer client.Close()
+	r, err := client.Bucket(u.Host).Object(strings.TrimPrefix(u.Path, "/")).NewReader(ctx)
+	if err != nil {
+		log.Printf("storage.ObjectHandle.NewReader: %v", err)
+		return nil, err
+	}
+	defer r.Close()
+	return readAllLimited(r)
+}
+
+// TLS configures the connection to the extraction source.
+type TLS struct {
+	// CARef is the PEM bundle of root CAs to trust instead of the system
+	// pool: a gs://bucket/object URL or a Secret Manager secret version,
+	// projects/*/secrets/*/versions/*.
+	CARef string `json:"caRef"`
+}
+
+// caClients caches an HTTP client per CA bundle for caCacheTTL, so that the
+// bundle is not fetched and connections are reused across requests. A bundle
+// is fetched once at a time by fetches, without holding the lock.
+var caClients = struct {
+	sync.Mutex
+	m       map[string]*caClient
+	fetches singleflight.Group
+}{m: map[string]*caClient{}}
+
+// caSources are the buckets, gs://bucket, and the secrets,
+// projects/*/secrets/*, that caRef may read with the service's credentials,
+// read from TLS_CA_SOURCES separated by commas. No caRef is read when it is
+// unset.
+var caSources = newAllowlist("TLS_CA_SOURCES")
+
+func caSourceAllowed(ref string) bool {
+	if strings.HasPrefix(ref, "gs://") {
+		u, err := neturl.Parse(ref)
+		return err == nil && caSources["gs://"+u.Host]
+	}
+	secret, _, _ := strings.Cut(ref, "/versions/")
+	return caSources[secret]
+}
+
+type caClient struct {
+	client  *http.Client
+	expires time.Time
+}
+
+const caCacheTTL = 5 * time.Minute
+
+func fetchCA(ref string) ([]byte, error) {
+	if !caSourceAllowed(ref) {
+		return nil, fmt.Errorf("tls: caRef not in TLS_CA_SOURCES: %q", ref)
+	}
+	if strings.HasPrefix(ref, "gs://") {
+		u, err := neturl.Parse(ref)
+		if err != nil {
+			return nil, err
+		}
+		return readObject(u)
+	}
+	if !strings.HasPrefix(ref, "projects/") {
+		return nil, fmt.Errorf("tls: invalid caRef: %q", ref)
+	}
+	svc, err := secretmanager.NewService(context.Background())
+	if err != nil {
+		log.Printf("secretmanager.NewService: %v", err)
+		return nil, err
+	}
+	res, err := svc.Projects.Secrets.Versions.Access(ref).Do()
+	if err != nil {
+		log.Printf("secretmanager.ProjectsSecretsVersionsAccessCall.Do: %v", err)
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(res.Payload.Data)
+}
+
+// client returns the HTTP client trusting the CA bundle of ref.
+func (t TLS) client() (*http.Client, error) {
+	caClients.Lock()
+	c, ok := caClients.m[t.CARef]
+	caClients.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.client, nil
+	}
+	client, err, _ := caClients.fetches.Do(t.CARef, func() (any, error) {
+		pem, err := fetchCA(t.CARef)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no certificates in %s", t.CARef)
+		}
+		transport := newTransport()
+		transport.TLSClientConfig.RootCAs = pool
+		c := &caClient{&http.Client{Transport: transport}, time.Now().Add(caCacheTTL)}
+		caClients.Lock()
+		defer caClients.Unlock()
+		if old, ok := caClients.m[t.CARef]; ok {
+			old.client.CloseIdleConnections()
+		}
+		caClients.m[t.CARef] = c
+		return c.client, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client.(*http.Client), nil
+}
+
+// Pages fetches a paginated source whose number of pages is known upfront.
+// {page} in the URL and the body is replaced by the page number, from Start
+// (default 1) to Start+Count-1.
+type Pages struct {
+	Count int  `json:"count"`
+	Start *int `json:"start"`
+	// Parallelism is the number of pages fetched at a time, default 4.
+	Parallelism int `json:"parallelism"`
+	// NoHeader keeps the first line of every page; otherwise it is kept
+	// only for the first page.
+	NoHeader bool `json:"noHeader"`
+}
+
+// extractPages fetches the pages concurrently and concatenates them in order.
+// Every page is buffered until all of them have been fetched, so
+// MAX_BUFFER_BYTES limits the pages together rather than each one.
+func (e *HTTPExtractor) extractPages() (io.ReadCloser, error) {
+	start := 1
+	if e.pages.Start != nil {
+		start = *e.pages.Start
+	}
+	parallelism := e.pages.Parallelism
+	if parallelism == 0 {
+		parallelism = 4
+	}
+	if maxPageParallelism > 0 && parallelism > maxPageParallelism {
+		parallelism = maxPageParallelism
+	}
+	bodies := make([][]byte, e.pages.Count)
+	var metadata Metadata
+	var mu sync.Mutex
+	var size int64
+	g, ctx := errgroup.WithContext(context.Background())
+	g.SetLimit(parallelism)
+	for i := range bodies {
+		i := i
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			page := strconv.Itoa(start + i)
+			p := *e
+			p.url = strings.ReplaceAll(e.url, "{page}", page)
+			p.body = strings.ReplaceAll(e.body, "{page}", page)
+			p.pages = nil
+			r, err := p.extract()
+			if err != nil {
+				return fmt.Errorf("page %s: %w", page, err)
+			}
+			defer r.Close()
+			b, err := readAllLimited(r)
+			if err != nil {
+				return fmt.Errorf("page %s: %w", page, err)
+			}
+			if i > 0 && !e.pages.NoHeader {
+				if n := bytes.IndexByte(b, '\n'); n >= 0 {
+					b = b[n+1:]
+				} else {
+					b = nil
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			size += int64(len(b))
+			if maxBufferBytes > 0 && size > maxBufferBytes {
+				return fmt.Errorf("pages: buffered data exceeds MAX_BUFFER_BYTES %d", maxBufferBytes)
+			}
+			if i == 0 {
+				metadata = p.metadata
+			}
+			bodies[i] = b
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	e.metadata = metadata
+	readers := make([]io.Reader, len(bodies))
+	for i, b := range bodies {
+		readers[i] = bytes.NewReader(b)
+	}
+	return io.NopCloser(io.MultiReader(readers...)), nil
+}
+
+// RawBody is a request body sent verbatim, such as a signed binary payload.
+type RawBody struct {
+	Data string `json:"data"`
+	// Encoding is empty for text, or base64 for binary data.
+	Encoding string `json:"encoding"`
+}
+
+func (b RawBody) decode() (string, error) {
+	switch b.Encoding {
+	case "":
+		return b.Data, nil
+	case "base64":
+		data, err := base64.StdEncoding.DecodeString(b.Data)
+		if err != nil {
+			return "", fmt.Errorf("rawBody: %v", err)
+		}
+		return string(data), nil
+	default:
+		return "", fmt.Errorf("rawBody: invalid encoding: %q", b.Encoding)
+	}
+}
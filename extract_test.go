@@ -0,0 +1,56 @@
+package main
+
+import (
+	"golang.org/x/time/rate"
+	"testing"
+)
+
+func TestNewHostLimiters(t *testing.T) {
+	tests := []struct {
+		rateLimit string
+		want      rate.Limit
+	}{
+		{"", rate.Inf},
+		{"0", rate.Inf},
+		{"2.5", 2.5},
+	}
+	for _, tt := range tests {
+		t.Setenv("RATE_LIMIT", tt.rateLimit)
+		l := newHostLimiters()
+		if l.limit != tt.want {
+			t.Errorf("RATE_LIMIT=%q: limit = %v, want %v", tt.rateLimit, l.limit, tt.want)
+		}
+	}
+
+	t.Setenv("RATE_LIMIT", "0")
+	l := newHostLimiters()
+	for i := 0; i < 10; i++ {
+		if !l.get("example.com").Allow() {
+			t.Fatalf("RATE_LIMIT=0: request %d not allowed", i+1)
+		}
+	}
+}
+
+func TestCASourceAllowed(t *testing.T) {
+	caSources = map[string]bool{"gs://certs": true, "projects/p/secrets/ca": true}
+	defer func() { caSources = map[string]bool{} }()
+	tests := []struct {
+		ref  string
+		want bool
+	}{
+		{"gs://certs/ca.pem", true},
+		{"gs://other/ca.pem", false},
+		{"projects/p/secrets/ca/versions/latest", true},
+		{"projects/p/secrets/ca/versions/3", true},
+		{"projects/p/secrets/db-password/versions/latest", false},
+		{"projects/q/secrets/ca/versions/latest", false},
+	}
+	for _, tt := range tests {
+		if got := caSourceAllowed(tt.ref); got != tt.want {
+			t.Errorf("caSourceAllowed(%q) = %v, want %v", tt.ref, got, tt.want)
+		}
+	}
+	if _, err := fetchCA("gs://other/ca.pem"); err == nil {
+		t.Errorf("fetchCA read a caRef not in TLS_CA_SOURCES")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jlaffaye/ftp"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"net"
+	neturl "net/url"
+	"time"
+)
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// SFTP holds the keys for sftp:// URLs. The password, if any, is taken from
+// the URL.
+type SFTP struct {
+	// HostKey is the server's public key in authorized_keys format.
+	HostKey string `json:"hostKey"`
+	// PrivateKey is a PEM encoded private key for public key authentication.
+	PrivateKey string `json:"privateKey"`
+}
+
+func hostPort(u *neturl.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func extractFTP(u *neturl.URL) (io.ReadCloser, error) {
+	c, err := ftp.Dial(hostPort(u, "21"), ftp.DialWithTimeout(30*time.Second))
+	if err != nil {
+		log.Printf("ftp.Dial: %v", err)
+		return nil, err
+	}
+	user, password := "anonymous", "anonymous"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	if err := c.Login(user, password); err != nil {
+		log.Printf("ftp.ServerConn.Login: %v", err)
+		c.Quit()
+		return nil, err
+	}
+	r, err := c.Retr(u.Path)
+	if err != nil {
+		log.Printf("ftp.ServerConn.Retr: %v", err)
+		c.Quit()
+		return nil, err
+	}
+	return ChainedCloser{r, closerFunc(func() error {
+		r.Close()
+		return c.Quit()
+	})}, nil
+}
+
+func extractSFTP(u *neturl.URL, s *SFTP) (io.ReadCloser, error) {
+	if s == nil || s.HostKey == "" {
+		return nil, fmt.Errorf("sftp: extraction.sftp.hostKey is required")
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.HostKey))
+	if err != nil {
+		return nil, fmt.Errorf("sftp: invalid hostKey: %v", err)
+	}
+	config := &ssh.ClientConfig{
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         30 * time.Second,
+	}
+	if u.User != nil {
+		config.User = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			config.Auth = append(config.Auth, ssh.Password(password))
+		}
+	}
+	if s.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(s.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("sftp: invalid privateKey: %v", err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+
+	conn, err := ssh.Dial("tcp", hostPort(u, "22"), config)
+	if err != nil {
+		log.Printf("ssh.Dial: %v", err)
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		log.Printf("sftp.NewClient: %v", err)
+		conn.Close()
+		return nil, err
+	}
+	f, err := client.Open(u.Path)
+	if err != nil {
+		log.Printf("sftp.Client.Open: %v", err)
+		client.Close()
+		conn.Close()
+		return nil, err
+	}
+	return ChainedCloser{f, closerFunc(func() error {
+		f.Close()
+		client.Close()
+		return conn.Close()
+	})}, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+// maxTweaks caps the number of tweaks in a single call, read from MAX_TWEAKS.
+var maxTweaks = newLimit("MAX_TWEAKS", 32)
+
+// maxBufferBytes caps how much a tweak may buffer in memory, read from
+// MAX_BUFFER_BYTES. Zero means no limit.
+var maxBufferBytes = int64(newLimit("MAX_BUFFER_BYTES", 0))
+
+// maxRequestBytes caps the request body, also after gzip decompression,
+// read from MAX_REQUEST_BYTES. Zero means no limit.
+var maxRequestBytes = int64(newLimit("MAX_REQUEST_BYTES", 32<<20))
+
+// maxPages caps pages.count, read from MAX_PAGES, since every page is held
+// until all have been fetched. Zero means no limit.
+var maxPages = newLimit("MAX_PAGES", 1000)
+
+// maxPageParallelism caps pages.parallelism, read from MAX_PAGE_PARALLELISM.
+// Zero means no limit.
+var maxPageParallelism = newLimit("MAX_PAGE_PARALLELISM", 16)
+
+// memoryBudget is how much a tweak keeps in memory before spilling to a
+// temporary file, read from MEMORY_BUDGET_BYTES. Zero means never spill.
+var memoryBudget = int64(newLimit("MEMORY_BUDGET_BYTES", 0))
+
+func newLimit(name string, defaultValue int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Fatalf("invalid %s: %q", name, v)
+	}
+	return n
+}
+
+// readAllLimited is io.ReadAll bounded by maxBufferBytes.
+func readAllLimited(r io.Reader) ([]byte, error) {
+	if maxBufferBytes == 0 {
+		return io.ReadAll(r)
+	}
+	b, err := io.ReadAll(io.LimitReader(r, maxBufferBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > maxBufferBytes {
+		return nil, fmt.Errorf("buffered data exceeds MAX_BUFFER_BYTES %d", maxBufferBytes)
+	}
+	return b, nil
+}
+
+// bufferedBytes counts the rows a tweak keeps in memory against
+// maxBufferBytes, estimating their size the same way as sort.
+type bufferedBytes struct {
+	call string
+	size int64
+}
+
+// addRow counts a new row of fields.
+func (b *bufferedBytes) addRow(fields ...string) error {
+	b.size += 24
+	return b.add(fields...)
+}
+
+// add counts fields added to a row already counted.
+func (b *bufferedBytes) add(fields ...string) error {
+	for _, f := range fields {
+		b.size += int64(len(f)) + 16
+	}
+	if maxBufferBytes > 0 && b.size > maxBufferBytes {
+		return fmt.Errorf("%s: buffered data exceeds MAX_BUFFER_BYTES %d", b.call, maxBufferBytes)
+	}
+	return nil
+}
+
+// spillBuffer holds a whole stream, in memory up to memoryBudget and in an
+// unlinked temporary file beyond it. It must be closed to release the file.
+type spillBuffer struct {
+	mem  []byte
+	file *os.File
+	size int64
+}
+
+// bufferAll reads r to the end into a spillBuffer. MAX_BUFFER_BYTES still
+// caps the total.
+func bufferAll(r io.Reader) (*spillBuffer, error) {
+	if memoryBudget == 0 || maxBufferBytes > 0 && maxBufferBytes <= memoryBudget {
+		b, err := readAllLimited(r)
+		return &spillBuffer{mem: b, size: int64(len(b))}, err
+	}
+	b, err := io.ReadAll(io.LimitReader(r, memoryBudget+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) <= memoryBudget {
+		return &spillBuffer{mem: b, size: int64(len(b))}, nil
+	}
+
+	f, err := os.CreateTemp("", "tweakle-")
+	if err != nil {
+		log.Printf("os.CreateTemp: %v", err)
+		return nil, err
+	}
+	// The file stays readable through f until it is closed.
+	os.Remove(f.Name())
+	rest := r
+	if maxBufferBytes > 0 {
+		rest = io.LimitReader(r, maxBufferBytes+1-int64(len(b)))
+	}
+	n, err := io.Copy(f, io.MultiReader(bytes.NewReader(b), rest))
+	if err != nil {
+		f.Close()
+		log.Printf("spill: %v", err)
+		return nil, err
+	}
+	if maxBufferBytes > 0 && n > maxBufferBytes {
+		f.Close()
+		return nil, fmt.Errorf("buffered data exceeds MAX_BUFFER_BYTES %d", maxBufferBytes)
+	}
+	log.Printf("spilled %d bytes over MEMORY_BUDGET_BYTES %d to a temporary file", n, memoryBudget)
+	return &spillBuffer{file: f, size: n}, nil
+}
+
+func (b *spillBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if b.file != nil {
+		return b.file.ReadAt(p, off)
+	}
+	return bytes.NewReader(b.mem).ReadAt(p, off)
+}
+
+// reader returns a new reader from the start that does not close b.
+func (b *spillBuffer) reader() io.Reader {
+	return io.NewSectionReader(b, 0, b.size)
+}
+
+func (b *spillBuffer) Close() error {
+	if b.file != nil {
+		return b.file.Close()
+	}
+	return nil
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"cloud.google.com/go/storage"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	"io"
+	"log"
+	neturl "net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// csvRecords reads the data records of a CSV stream being split into several
+// objects.
+type csvRecords struct {
+	cr      *csv.Reader
+	pending []string
+	// header is written at the top of every object; nil with noHeader.
+	header []string
+}
+
+// newCSVRecords reads the header of r. It returns the header names to reply
+// with, which are generated when l.noHeader is set.
+func (l CloudStorageLoader) newCSVRecords(r io.Reader) (*csvRecords, []string, error) {
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(3); err == nil && bom[0] == 0xEF && bom[1] == 0xBB && bom[2] == 0xBF {
+		br.Discard(3)
+	}
+	cr := csv.NewReader(br)
+	cr.LazyQuotes = true
+	cr.FieldsPerRecord = -1
+
+	first, err := cr.Read()
+	if err != nil {
+		log.Printf("csv.Reader.Read: %v", err)
+		return nil, nil, err
+	}
+	if err := l.checkColumns(first); err != nil {
+		return nil, nil, err
+	}
+	if !l.noHeader {
+		if err := l.checkExpectedColumns(first); err != nil {
+			return nil, nil, err
+		}
+		return &csvRecords{cr: cr, header: first}, first, nil
+	}
+	names := make([]string, len(first))
+	for i := range first {
+		names[i] = fmt.Sprintf("col_%d", i+1)
+	}
+	if err := l.checkExpectedColumns(names); err != nil {
+		return nil, nil, err
+	}
+	return &csvRecords{cr: cr, pending: first}, names, nil
+}
+
+// next returns the next data record, or io.EOF.
+func (c *csvRecords) next() ([]string, error) {
+	if c.pending != nil {
+		record := c.pending
+		c.pending = nil
+		return record, nil
+	}
+	record, err := c.cr.Read()
+	if err != nil && err != io.EOF {
+		log.Printf("csv.Reader.Read: %v", err)
+	}
+	return record, err
+}
+
+// csvObject is an object being written as CSV.
+type csvObject struct {
+	name string
+	wc   *storage.Writer
+	cw   *csv.Writer
+	rows int
+}
+
+// newCSVObject starts writing an object. chunkSize overrides the upload
+// buffer size of the writer when not zero.
+func (l CloudStorageLoader) newCSVObject(ctx context.Context, client *storage.Client, name string, header []string, chunkSize int) (*csvObject, error) {
+	wc := client.Bucket(l.bucketName).Object(name).NewWriter(ctx)
+	if chunkSize != 0 {
+		wc.ChunkSize = chunkSize
+	}
+	o := &csvObject{name: name, wc: wc, cw: csv.NewWriter(wc)}
+	if header != nil {
+		if err := o.cw.Write(header); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (o *csvObject) write(record []string) error {
+	o.rows++
+	return o.cw.Write(record)
+}
+
+func (o *csvObject) close() error {
+	o.cw.Flush()
+	if err := o.cw.Error(); err != nil {
+		log.Printf("csv.Writer.Flush: %v", err)
+		return err
+	}
+	if err := o.wc.Close(); err != nil {
+		log.Printf("Writer.Close: %v", err)
+		return err
+	}
+	return nil
+}
+
+// chunkName returns the object name of the i-th chunk, e.g. data-000001.csv.
+// The number replaces {chunk} in the object name instead when present, e.g.
+// data_001.csv.
+func (l CloudStorageLoader) chunkName(i int) string {
+	if strings.Contains(l.objectName, "{chunk}") {
+		return strings.ReplaceAll(l.objectName, "{chunk}", fmt.Sprintf("%03d", i))
+	}
+	ext := path.Ext(l.objectName)
+	return fmt.Sprintf("%s-%06d%s", strings.TrimSuffix(l.objectName, ext), i, ext)
+}
+
+type Chunk struct {
+	Object string `json:"object"`
+	Rows   int    `json:"rows"`
+}
+
+// loadChunks uploads r as objects of at most l.chunkRows data rows each,
+// repeating the header in every chunk. Only the last chunk can be partial.
+func (l CloudStorageLoader) loadChunks(ctx context.Context, client *storage.Client, r io.Reader) (*Reply, error) {
+	records, header, err := l.newCSVRecords(r)
+	if err != nil {
+		return nil, err
+	}
+	reply := &Reply{Header: header}
+
+	var o *csvObject
+	for {
+		record, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if o == nil {
+			name := l.chunkName(len(reply.Objects) + 1)
+			if o, err = l.newCSVObject(ctx, client, name, records.header, 0); err != nil {
+				return nil, err
+			}
+			reply.Objects = append(reply.Objects, name)
+		}
+		if err := o.write(record); err != nil {
+			return nil, err
+		}
+		if o.rows == l.chunkRows {
+			if err := o.close(); err != nil {
+				return nil, err
+			}
+			reply.Chunks = append(reply.Chunks, Chunk{o.name, o.rows})
+			o = nil
+		}
+	}
+	// Upload a header-only chunk when there are no data rows.
+	if len(reply.Objects) == 0 {
+		name := l.chunkName(1)
+		if o, err = l.newCSVObject(ctx, client, name, records.header, 0); err != nil {
+			return nil, err
+		}
+		reply.Objects = append(reply.Objects, name)
+	}
+	if o != nil {
+		if err := o.close(); err != nil {
+			return nil, err
+		}
+		reply.Chunks = append(reply.Chunks, Chunk{o.name, o.rows})
+	}
+	return reply, nil
+}
+
+type Partition struct {
+	Value  string `json:"value"`
+	Object string `json:"object"`
+	Rows   int    `json:"rows"`
+}
+
+// partitionName returns the object name for a partition value. The value
+// replaces {value} in the object name, or is appended before the extension.
+func (l CloudStorageLoader) partitionName(value string) string {
+	value = neturl.PathEscape(value)
+	if strings.Contains(l.objectName, "{value}") {
+		return strings.ReplaceAll(l.objectName, "{value}", value)
+	}
+	ext := path.Ext(l.objectName)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(l.objectName, ext), value, ext)
+}
+
+// partitionValue returns the partition of a column value.
+func (l CloudStorageLoader) partitionValue(value string) (string, error) {
+	if l.partitionPattern == nil {
+		return value, nil
+	}
+	m := l.partitionPattern.FindStringSubmatch(value)
+	if m == nil {
+		return "", fmt.Errorf("%q does not match partitionPattern", value)
+	}
+	if len(m) > 1 {
+		return m[1], nil
+	}
+	return m[0], nil
+}
+
+// loadPartitions uploads one object per distinct value of l.partitionColumn,
+// each with the header. More than l.maxPartitions distinct values is an error.
+func (l CloudStorageLoader) loadPartitions(ctx context.Context, client *storage.Client, r io.Reader) (*Reply, error) {
+	records, header, err := l.newCSVRecords(r)
+	if err != nil {
+		return nil, err
+	}
+	column, err := columnIndex(header, l.partitionColumn)
+	if err != nil {
+		return nil, err
+	}
+	reply := &Reply{Header: header}
+
+	objects := map[string]*csvObject{}
+	for {
+		record, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		value, err := l.partitionValue(field(record, column))
+		if err != nil {
+			return nil, err
+		}
+		o, ok := objects[value]
+		if !ok {
+			if len(objects) == l.maxPartitions {
+				return nil, fmt.Errorf("more than %d partitions", l.maxPartitions)
+			}
+			// Keep the buffer of each of the many open writers small.
+			if o, err = l.newCSVObject(ctx, client, l.partitionName(value), records.header, 256*1024); err != nil {
+				return nil, err
+			}
+			objects[value] = o
+			reply.Partitions = append(reply.Partitions, Partition{Value: value, Object: o.name})
+		}
+		if err := o.write(record); err != nil {
+			return nil, err
+		}
+	}
+	for i, p := range reply.Partitions {
+		o := objects[p.Value]
+		if err := o.close(); err != nil {
+			return nil, err
+		}
+		reply.Partitions[i].Rows = o.rows
+		reply.Objects = append(reply.Objects, o.name)
+	}
+	return reply, nil
+}
+
+// EAV splits a wide CSV into the core columns and an entity-attribute-value
+// object holding the non-empty values of the other columns.
+type EAV struct {
+	Core   []string `json:"core"`
+	Key    string   `json:"key"`
+	Object string   `json:"object"`
+}
+
+// loadEAV uploads the core columns to l.objectName and the remaining columns
+// but the key as (key, attribute, value) rows to l.eav.Object.
+func (l CloudStorageLoader) loadEAV(ctx context.Context, client *storage.Client, r io.Reader) (*Reply, error) {
+	records, header, err := l.newCSVRecords(r)
+	if err != nil {
+		return nil, err
+	}
+	var core []int
+	isCore := map[int]bool{}
+	for _, c := range l.eav.Core {
+		i, err := columnIndex(header, c)
+		if err != nil {
+			return nil, err
+		}
+		core = append(core, i)
+		isCore[i] = true
+	}
+	keyName := l.eav.Key
+	if keyName == "" {
+		keyName = l.eav.Core[0]
+	}
+	key, err := columnIndex(header, keyName)
+	if err != nil {
+		return nil, err
+	}
+
+	coreHeader := make([]string, len(core))
+	for j, i := range core {
+		coreHeader[j] = header[i]
+	}
+	coreObject, err := l.newCSVObject(ctx, client, l.objectName, coreHeader, 0)
+	if err != nil {
+		return nil, err
+	}
+	eav, err := l.newCSVObject(ctx, client, l.eav.Object, []string{keyName, "attribute", "value"}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		record, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := make([]string, len(core))
+		for j, i := range core {
+			row[j] = field(record, i)
+		}
+		if err := coreObject.write(row); err != nil {
+			return nil, err
+		}
+		for i, value := range record {
+			if isCore[i] || i == key || value == "" || i >= len(header) {
+				continue
+			}
+			if err := eav.write([]string{field(record, key), header[i], value}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := coreObject.close(); err != nil {
+		return nil, err
+	}
+	if err := eav.close(); err != nil {
+		return nil, err
+	}
+	return &Reply{Header: coreHeader, Objects: []string{coreObject.name, eav.name}}, nil
+}
+
+// impersonationTargets are the service accounts that serviceAccount may
+// impersonate with the service's own rights, read from
+// IMPERSONATE_SERVICE_ACCOUNTS separated by commas. None may be impersonated
+// when it is unset.
+var impersonationTargets = newAllowlist("IMPERSONATE_SERVICE_ACCOUNTS")
+
+// impersonated caches a token source per impersonated service account so that
+// a token is reused until it expires.
+var impersonated = struct {
+	sync.Mutex
+	m map[string]oauth2.TokenSource
+}{m: map[string]oauth2.TokenSource{}}
+
+// clientOptions returns the credentials of the storage client. The service
+// account is a JSON service account key, or the email of a service account in
+// impersonationTargets to impersonate; Application Default Credentials are
+// used when it is empty. Other credential types are refused since they make
+// the service read files or fetch URLs named by the caller.
+func (l CloudStorageLoader) clientOptions() ([]option.ClientOption, error) {
+	sa := strings.TrimSpace(l.serviceAccount)
+	switch {
+	case sa == "":
+		return nil, nil
+	case strings.HasPrefix(sa, "{"):
+		var key struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal([]byte(sa), &key); err != nil {
+			return nil, fmt.Errorf("serviceAccount: invalid key: %v", err)
+		}
+		if key.Type != "service_account" {
+			return nil, fmt.Errorf("serviceAccount: unsupported credential type: %q", key.Type)
+		}
+		return []option.ClientOption{option.WithCredentialsJSON([]byte(sa))}, nil
+	case strings.Contains(sa, "@") && !strings.Contains(sa, "/"):
+		if !impersonationTargets[sa] {
+			return nil, fmt.Errorf("serviceAccount: not in IMPERSONATE_SERVICE_ACCOUNTS: %q", sa)
+		}
+		impersonated.Lock()
+		defer impersonated.Unlock()
+		ts, ok := impersonated.m[sa]
+		if !ok {
+			var err error
+			ts, err = impersonate.CredentialsTokenSource(context.Background(), impersonate.CredentialsConfig{
+				TargetPrincipal: sa,
+				Scopes:          []string{storage.ScopeReadWrite},
+			})
+			if err != nil {
+				log.Printf("impersonate.CredentialsTokenSource: %v", err)
+				return nil, err
+			}
+			impersonated.m[sa] = ts
+		}
+		return []option.ClientOption{option.WithTokenSource(ts)}, nil
+	default:
+		return nil, fmt.Errorf("serviceAccount: must be a service account key or email")
+	}
+}
+
+// SchemaColumn describes a column in the schema artifact. SanitizedName only
+// has letters, digits and underscores, as BigQuery required before flexible
+// column names.
+type SchemaColumn struct {
+	Name          string `json:"name"`
+	SanitizedName string `json:"sanitizedName"`
+}
+
+var invalidColumnChars = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+func sanitizeColumnName(name string) string {
+	s := invalidColumnChars.ReplaceAllString(name, "_")
+	if s == "" || s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	return s
+}
+
+// writeSchema uploads the header as a JSON schema artifact for catalog
+// tooling.
+func (l CloudStorageLoader) writeSchema(ctx context.Context, client *storage.Client, header []string) error {
+	columns := make([]SchemaColumn, len(header))
+	for i, name := range header {
+		columns[i] = SchemaColumn{name, sanitizeColumnName(name)}
+	}
+	b, err := json.MarshalIndent(map[string]any{
+		"bucket":  l.bucketName,
+		"object":  l.objectName,
+		"columns": columns,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	wc := client.Bucket(l.bucketName).Object(l.schemaObject).NewWriter(ctx)
+	wc.ContentType = "application/json"
+	if _, err := wc.Write(b); err != nil {
+		log.Printf("Writer.Write: %v", err)
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		log.Printf("Writer.Close: %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestClientOptions(t *testing.T) {
+	impersonationTargets = map[string]bool{"allowed@project.iam.gserviceaccount.com": true}
+	defer func() { impersonationTargets = map[string]bool{} }()
+	tests := []struct {
+		serviceAccount string
+		ok             bool
+	}{
+		{"", true},
+		{`{"type": "service_account", "client_email": "sa@project.iam.gserviceaccount.com"}`, true},
+		{"/etc/passwd", false},
+		{"key.json", false},
+		{`{"type": "external_account", "token_url": "http://169.254.169.254/"}`, false},
+		{`{"type": "authorized_user"}`, false},
+		{`{"type"`, false},
+		{"other@project.iam.gserviceaccount.com", false},
+	}
+	for _, tt := range tests {
+		_, err := CloudStorageLoader{serviceAccount: tt.serviceAccount}.clientOptions()
+		if (err == nil) != tt.ok {
+			t.Errorf("clientOptions(%q) error = %v, want ok %v", tt.serviceAccount, err, tt.ok)
+		}
+	}
+}
+
+func TestLoadEAV(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string]string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		var object struct {
+			Name   string `json:"name"`
+			Bucket string `json:"bucket"`
+		}
+		part, err := mr.NextPart()
+		if err == nil {
+			err = json.NewDecoder(part).Decode(&object)
+		}
+		if err == nil {
+			part, err = mr.NextPart()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(part)
+		mu.Lock()
+		objects[object.Name] = string(b)
+		mu.Unlock()
+		json.NewEncoder(w).Encode(object)
+	}))
+	defer ts.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(ts.URL, "http://"))
+
+	l := CloudStorageLoader{
+		bucketName:   "bucket",
+		objectName:   "core.csv",
+		sourceFormat: "CSV",
+		maxColumns:   100,
+		eav:          &EAV{Core: []string{"name"}, Key: "id", Object: "eav.csv"},
+	}
+	reply, err := l.load(strings.NewReader("id,name,color,size\n1,a,red,\n2,b,,L\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(reply.Header, ","); got != "name" {
+		t.Errorf("header = %q, want %q", got, "name")
+	}
+	if got, want := objects["core.csv"], "name\na\nb\n"; got != want {
+		t.Errorf("core.csv = %q, want %q", got, want)
+	}
+	if got, want := objects["eav.csv"], "id,attribute,value\n1,color,red\n2,size,L\n"; got != want {
+		t.Errorf("eav.csv = %q, want %q", got, want)
+	}
+}
@@ -5,16 +5,22 @@ import (
 	"bufio"
 	"bytes"
 	"cloud.google.com/go/storage"
+	"compress/gzip"
 	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"golang.org/x/net/html/charset"
 	"io"
 	"log"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ChainedCloser struct {
@@ -26,30 +32,198 @@ func (c ChainedCloser) Read(p []byte) (n int, err error) { return c.r.Read(p) }
 func (c ChainedCloser) Close() error                     { return c.c.Close() }
 
 type HTTPExtractor struct {
-	method string
-	url    string
-	body   string
+	method    string
+	url       string
+	body      string
+	preflight bool
+	maxBytes  int64
+	headers   map[string]string
+	oauth2    *OAuth2
+	sftp      *SFTP
+	mirrors   []string
+	headBytes int64
+	noCache   bool
+	// contentType of the request body, application/x-www-form-urlencoded
+	// when empty.
+	contentType  string
+	bodyTemplate *BodyTemplate
+	tls          *TLS
+	pages        *Pages
+	// responseHeaders are the names of the response headers to reply with.
+	responseHeaders []string
+	metadata        Metadata
 }
 
-func (e HTTPExtractor) Extract() (io.ReadCloser, error) {
-	req, err := http.NewRequest(e.method, e.url, strings.NewReader(e.body))
+func (e *HTTPExtractor) newRequest(method string, url string, body string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
 	if err != nil {
 		log.Printf("http.NewRequest: %v", err)
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	contentType := "application/x-www-form-urlencoded"
+	if e.contentType != "" {
+		contentType = e.contentType
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range defaultHeaders {
+		req.Header[k] = v
+	}
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	if e.oauth2 != nil {
+		token, err := e.oauth2.tokenSource().Token()
+		if err != nil {
+			log.Printf("oauth2.TokenSource.Token: %v", err)
+			return nil, err
+		}
+		token.SetAuthHeader(req)
+	}
+
+	if err := limiters.get(req.URL.Host).Wait(req.Context()); err != nil {
+		log.Printf("rate.Limiter.Wait: %v", err)
+		return nil, err
+	}
+	return req, nil
+}
+
+// Extract fetches the source, from the cache when enabled.
+func (e *HTTPExtractor) Extract() (io.ReadCloser, error) {
+	if e.bodyTemplate != nil {
+		body, err := e.bodyTemplate.render()
+		if err != nil {
+			return nil, err
+		}
+		e.body = body
+	}
+	if cache.ttl == 0 || e.noCache {
+		return e.extract()
+	}
+	key := e.cacheKey()
+	if entry, ok := cache.get(key); ok {
+		log.Printf("extracted from cache")
+		e.metadata = entry.metadata
+		return io.NopCloser(bytes.NewReader(entry.body)), nil
+	}
+	r, err := e.extract()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := readAllLimited(r)
+	if err != nil {
+		return nil, err
+	}
+	cache.put(key, b, e.metadata)
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (e *HTTPExtractor) extract() (io.ReadCloser, error) {
+	if e.pages != nil {
+		return e.extractPages()
+	}
+	if u, err := neturl.Parse(e.url); err == nil && (u.Scheme == "ftp" || u.Scheme == "sftp") {
+		if err := limiters.get(u.Host).Wait(context.Background()); err != nil {
+			log.Printf("rate.Limiter.Wait: %v", err)
+			return nil, err
+		}
+		return breakers.call(u.Host, func() (io.ReadCloser, error) {
+			if u.Scheme == "ftp" {
+				return extractFTP(u)
+			}
+			return extractSFTP(u, e.sftp)
+		})
+	}
+
+	// Mirrors are tried in order when the primary URL fails with a retryable error.
+	var err error
+	for i, url := range append([]string{e.url}, e.mirrors...) {
+		host := url
+		if u, err := neturl.Parse(url); err == nil {
+			host = u.Host
+		}
+		var body io.ReadCloser
+		body, err = breakers.call(host, func() (io.ReadCloser, error) {
+			return e.extractHTTP(url)
+		})
+		if err == nil {
+			if i > 0 {
+				log.Printf("extracted from mirror %s", url)
+			}
+			return body, nil
+		}
+		if !isRetryable(err) {
+			return nil, err
+		}
+		log.Printf("extraction from %s failed: %v", url, err)
+	}
+	return nil, err
+}
 
-	res, err := http.DefaultClient.Do(req)
+func (e *HTTPExtractor) extractHTTP(url string) (io.ReadCloser, error) {
+	client := httpClient
+	if e.tls != nil && e.tls.CARef != "" {
+		var err error
+		if client, err = e.tls.client(); err != nil {
+			return nil, err
+		}
+	}
+	if e.preflight {
+		req, err := e.newRequest(http.MethodHead, url, "")
+		if err != nil {
+			return nil, err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			log.Printf("http.Client.Do: %v", err)
+			return nil, err
+		}
+		res.Body.Close()
+		// Servers that do not support HEAD are left to the actual request.
+		if res.StatusCode <= 299 {
+			e.metadata = newMetadata(res)
+			log.Printf("preflight: %+v", e.metadata)
+			if err := e.metadata.check(e.maxBytes); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	req, err := e.newRequest(e.method, url, e.body)
 	if err != nil {
-		log.Printf("http.DefaultClient.Do: %v", err)
 		return nil, err
 	}
+	if e.headBytes > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", e.headBytes-1))
+	}
+	debugRequest(req, e.body)
+	res, err := client.Do(req)
+	if err != nil {
+		log.Printf("http.Client.Do: %v", err)
+		return nil, err
+	}
+	debugResponse(res)
 	if res.StatusCode > 299 {
 		io.Copy(io.Discard, res.Body)
 		res.Body.Close()
-		return nil, fmt.Errorf("Response failed with status code: %d\n", res.StatusCode)
+		return nil, StatusError{res.StatusCode}
+	}
+	e.metadata = newMetadata(res)
+	if err := e.metadata.check(e.maxBytes); err != nil {
+		res.Body.Close()
+		return nil, err
 	}
 
+	if e.headBytes > 0 {
+		// Servers that ignore Range send the whole body with 200.
+		if res.StatusCode != http.StatusPartialContent {
+			log.Printf("Range ignored, truncating to %d bytes", e.headBytes)
+		}
+		return ChainedCloser{io.LimitReader(res.Body, e.headBytes), res.Body}, nil
+	}
+	if e.maxBytes > 0 {
+		return ChainedCloser{&MaxBytesReader{res.Body, e.maxBytes}, res.Body}, nil
+	}
 	return res.Body, nil
 }
 
@@ -58,12 +232,34 @@ type Tweaker interface {
 }
 
 type CharsetConverter struct {
-	label string
+	label     string
+	fallbacks []string
+	sniffBOM  bool
+	// detect guesses label from the beginning of the data.
+	detect bool
 }
 
 func (t CharsetConverter) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
-	nr, err := charset.NewReaderLabel(t.label, reader)
+	var r io.Reader = reader
+	label := t.label
+	if t.detect {
+		br := bufio.NewReaderSize(reader, detectBytes)
+		sample, _ := br.Peek(detectBytes)
+		label, r = detectCharset(sample, t.fallbacks), br
+	}
+	nr, err := charset.NewReaderLabel(label, r)
+	for _, label := range t.fallbacks {
+		if err == nil {
+			break
+		}
+		log.Printf("charset.NewReaderLabel: %v, trying %s", err, label)
+		nr, err = charset.NewReaderLabel(label, r)
+	}
+	if err != nil && t.sniffBOM {
+		nr, err = sniffBOM(r, err)
+	}
 	if err != nil {
+		reader.Close()
 		return nil, err
 	}
 	return ChainedCloser{nr, reader}, nil
@@ -72,40 +268,158 @@ func (t CharsetConverter) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
 type ZipFileOpener struct{}
 
 func (t ZipFileOpener) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
-	b, err := io.ReadAll(reader)
+	b, err := bufferAll(reader)
 	if err != nil {
+		reader.Close()
 		return nil, err
 	}
 	reader.Close()
 
-	r, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	r, err := zip.NewReader(b, b.size)
 
 	if err != nil {
+		b.Close()
 		return nil, err
 	}
 
 	if len(r.File) == 0 {
+		b.Close()
 		return nil, nil
 	}
-	return r.File[0].Open()
+	rc, err := r.File[0].Open()
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	return ChainedCloser{rc, closerFunc(func() error {
+		rc.Close()
+		return b.Close()
+	})}, nil
 }
 
 type CloudStorageLoader struct {
-	bucketName string
-	objectName string
+	bucketName      string
+	objectName      string
+	noHeader        bool
+	sourceFormat    string
+	chunkRows       int
+	partitionColumn string
+	maxPartitions   int
+	// partitionPattern, when set, maps a column value to its first submatch,
+	// or the whole match without a group.
+	partitionPattern *regexp.Regexp
+	eav              *EAV
+	serviceAccount   string
+	maxColumns       int
+	schemaObject     string
+	minRows          int
+	expectedColumns  []string
+	// expectedColumnsOrdered also compares the order of the columns.
+	expectedColumnsOrdered bool
 }
 
-func (l CloudStorageLoader) load(r io.Reader) ([]string, error) {
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+var errTooFewRows = errors.New("too few rows")
+
+// checkColumns rejects a pathological header before it is replied or split.
+func (l CloudStorageLoader) checkColumns(header []string) error {
+	if len(header) > l.maxColumns {
+		return fmt.Errorf("%d columns exceed maxColumns %d", len(header), l.maxColumns)
+	}
+	return nil
+}
+
+// checkExpectedColumns compares the sanitized header with expectedColumns,
+// case insensitively as BigQuery does, and describes any difference.
+func (l CloudStorageLoader) checkExpectedColumns(header []string) error {
+	if len(l.expectedColumns) == 0 {
+		return nil
+	}
+	normalize := func(name string) string { return strings.ToLower(sanitizeColumnName(name)) }
+	got := map[string]bool{}
+	for _, h := range header {
+		got[normalize(h)] = true
+	}
+	want := map[string]bool{}
+	var missing, extra []string
+	for _, c := range l.expectedColumns {
+		want[normalize(c)] = true
+		if !got[normalize(c)] {
+			missing = append(missing, c)
+		}
+	}
+	for _, h := range header {
+		if !want[normalize(h)] {
+			extra = append(extra, h)
+		}
+	}
+	if missing != nil || extra != nil {
+		return fmt.Errorf("columns do not match expectedColumns: missing %q, extra %q", missing, extra)
+	}
+	if l.expectedColumnsOrdered {
+		for i, h := range header {
+			if i >= len(l.expectedColumns) || normalize(h) != normalize(l.expectedColumns[i]) {
+				return fmt.Errorf("columns are not in the order of expectedColumns: %q", header)
+			}
+		}
+	}
+	return nil
+}
+
+func (l CloudStorageLoader) load(r io.Reader) (*Reply, error) {
+	// Cancelling the context before wc.Close aborts the upload.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts, err := l.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	client, err := storage.NewClient(ctx, opts...)
 	if err != nil {
 		log.Printf("storage.NewClient: %v", err)
 		return nil, err
 	}
 	defer client.Close()
 
+	reply, err := l.upload(ctx, client, r)
+	if err != nil {
+		return nil, err
+	}
+	// A schema built from the header needs distinct field names.
+	if reply.Header != nil {
+		reply.Header = dedupNames(reply.Header)
+	}
+	if l.schemaObject != "" && reply.Header != nil {
+		if err := l.writeSchema(ctx, client, reply.Header); err != nil {
+			return nil, err
+		}
+		reply.Schema = l.schemaObject
+	}
+	return reply, nil
+}
+
+func (l CloudStorageLoader) upload(ctx context.Context, client *storage.Client, r io.Reader) (*Reply, error) {
 	o := client.Bucket(l.bucketName).Object(l.objectName)
 	wc := o.NewWriter(ctx)
+	if l.sourceFormat != "CSV" {
+		if _, err := io.Copy(wc, r); err != nil {
+			log.Printf("io.Copy: %v", err)
+			return nil, err
+		}
+		if err := wc.Close(); err != nil {
+			log.Printf("Writer.Close: %v", err)
+			return nil, err
+		}
+		return &Reply{}, nil
+	}
+	if l.chunkRows > 0 {
+		return l.loadChunks(ctx, client, r)
+	}
+	if l.partitionColumn != "" {
+		return l.loadPartitions(ctx, client, r)
+	}
+	if l.eav != nil {
+		return l.loadEAV(ctx, client, r)
+	}
 	br := bufio.NewReader(io.TeeReader(r, wc))
 	bom, err := br.Peek(3)
 	if err != nil {
@@ -122,13 +436,42 @@ func (l CloudStorageLoader) load(r io.Reader) ([]string, error) {
 		log.Printf("csv.Reader.Read: %v", err)
 		return nil, err
 	}
+	if err := l.checkColumns(header); err != nil {
+		return nil, err
+	}
+	rows := 0
+	if l.noHeader {
+		rows++
+		for i := range header {
+			header[i] = fmt.Sprintf("col_%d", i+1)
+		}
+	}
+	if err := l.checkExpectedColumns(header); err != nil {
+		return nil, err
+	}
+	if l.minRows > 0 {
+		cr.FieldsPerRecord = -1
+		for {
+			if _, err := cr.Read(); err == io.EOF {
+				break
+			} else if err != nil {
+				log.Printf("csv.Reader.Read: %v", err)
+				return nil, err
+			}
+			rows++
+		}
+		// Returning before wc.Close aborts the upload.
+		if rows < l.minRows {
+			return nil, fmt.Errorf("%w: %d data rows, minRows is %d", errTooFewRows, rows, l.minRows)
+		}
+	}
 	io.Copy(io.Discard, br)
 
 	if err := wc.Close(); err != nil {
 		log.Printf("Writer.Close: %v", err)
 		return nil, err
 	}
-	return header, nil
+	return &Reply{Header: header}, nil
 }
 
 func main() {
@@ -144,11 +487,32 @@ func main() {
 
 	// Start HTTP server.
 	log.Printf("listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := newServer(":" + port).ListenAndServe(); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// newServer returns the server with READ_TIMEOUT, WRITE_TIMEOUT and
+// IDLE_TIMEOUT. The write timeout bounds the whole call, so it defaults to the
+// longest request timeout of Cloud Run.
+func newServer(addr string) *http.Server {
+	timeout := func(name string, d time.Duration) time.Duration {
+		if v := os.Getenv(name); v != "" {
+			var err error
+			if d, err = time.ParseDuration(v); err != nil || d < 0 {
+				log.Fatalf("invalid %s: %q", name, v)
+			}
+		}
+		return d
+	}
+	return &http.Server{
+		Addr:         addr,
+		ReadTimeout:  timeout("READ_TIMEOUT", time.Minute),
+		WriteTimeout: timeout("WRITE_TIMEOUT", time.Hour),
+		IdleTimeout:  timeout("IDLE_TIMEOUT", 2*time.Minute),
+	}
+}
+
 type Input struct {
 	RequestId          string            `json:"requestId"`
 	Caller             string            `json:"caller"`
@@ -157,14 +521,89 @@ type Input struct {
 	Calls              [][]any           `json:"calls"`
 }
 
-func parseCall(call []any) (*HTTPExtractor, []Tweaker, *CloudStorageLoader, error) {
-	if len(call) != 7 {
-		return nil, nil, nil, fmt.Errorf("invalid number of input fields provided.  expected 7, got  %d", len(call))
+type Options struct {
+	Extraction Extraction `json:"extraction"`
+	Tweaks     []Tweak    `json:"tweaks"`
+	Loading    Loading    `json:"loading"`
+	// Pipeline runs every tweak stage on its own goroutine.
+	Pipeline bool `json:"pipeline"`
+}
+
+type Extraction struct {
+	Preflight bool              `json:"preflight"`
+	MaxBytes  int64             `json:"maxBytes"`
+	Headers   map[string]string `json:"headers"`
+	OAuth2    *OAuth2           `json:"oauth2"`
+	SFTP      *SFTP             `json:"sftp"`
+	Mirrors   []string          `json:"mirrors"`
+	HeadBytes int64             `json:"headBytes"`
+	// Cache can be set to false to bypass CACHE_TTL.
+	Cache   *bool    `json:"cache"`
+	GraphQL *GraphQL `json:"graphql"`
+	// BodyTemplate renders the body at extraction time.
+	BodyTemplate *BodyTemplate `json:"bodyTemplate"`
+	TLS          *TLS          `json:"tls"`
+	Pages        *Pages        `json:"pages"`
+	RawBody      *RawBody      `json:"rawBody"`
+	// ContentType of the request body, overriding the default of
+	// application/x-www-form-urlencoded.
+	ContentType string `json:"contentType"`
+	// ResponseHeaders selects response headers to reply with for debugging;
+	// "*" selects all of them.
+	ResponseHeaders []string `json:"responseHeaders"`
+}
+
+type Loading struct {
+	NoHeader        bool   `json:"noHeader"`
+	SourceFormat    string `json:"sourceFormat"`
+	ChunkRows       int    `json:"chunkRows"`
+	PartitionColumn string `json:"partitionColumn"`
+	// PartitionPattern extracts the partition value from the column value.
+	PartitionPattern string `json:"partitionPattern"`
+	MaxPartitions    *int   `json:"maxPartitions"`
+	EAV              *EAV   `json:"eav"`
+	ServiceAccount   string `json:"serviceAccount"`
+	MaxColumns       int    `json:"maxColumns"`
+	SchemaObject     string `json:"schemaObject"`
+	MinRows          int    `json:"minRows"`
+	// ExpectedColumns fails the load when the sanitized header differs.
+	ExpectedColumns        []string `json:"expectedColumns"`
+	ExpectedColumnsOrdered bool     `json:"expectedColumnsOrdered"`
+}
+
+func parseOptions(v any) (*Options, error) {
+	var options Options
+	if v == nil {
+		return &options, nil
+	}
+	data, ok := v.(string)
+	if !ok {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		data = string(b)
+	}
+	d := json.NewDecoder(strings.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&options); err != nil {
+		return nil, fmt.Errorf("invalid options: %v", err)
+	}
+	return &options, nil
+}
+
+func parseCall(call []any, start time.Time) (*HTTPExtractor, []Tweaker, *CloudStorageLoader, error) {
+	if len(call) != 7 && len(call) != 8 {
+		return nil, nil, nil, fmt.Errorf("invalid number of input fields provided.  expected 7 or 8, got  %d", len(call))
 	}
 	method, ok := call[0].(string)
 	if !ok {
 		return nil, nil, nil, fmt.Errorf("invalid method type. expected string")
 	}
+	method, err := normalizeMethod(method)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 	url, ok := call[1].(string)
 	if !ok {
 		return nil, nil, nil, fmt.Errorf("invalid url type. expected string")
@@ -189,76 +628,322 @@ func parseCall(call []any) (*HTTPExtractor, []Tweaker, *CloudStorageLoader, erro
 	if !ok {
 		return nil, nil, nil, fmt.Errorf("invalid object type. expected string")
 	}
+	var opts any
+	if len(call) == 8 {
+		opts = call[7]
+	}
+	options, err := parseOptions(opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if options.Extraction.HeadBytes < 0 || options.Extraction.HeadBytes > 0 && options.Extraction.MaxBytes > 0 {
+		return nil, nil, nil, fmt.Errorf("invalid headBytes: %d, it can not be used with maxBytes", options.Extraction.HeadBytes)
+	}
+	var contentType string
+	if q := options.Extraction.GraphQL; q != nil {
+		if body != "" || !strings.EqualFold(method, http.MethodPost) {
+			return nil, nil, nil, fmt.Errorf("graphql requires method POST and an empty body")
+		}
+		if body, err = q.body(); err != nil {
+			return nil, nil, nil, err
+		}
+		contentType = "application/json"
+	}
+	if p := options.Extraction.Pages; p != nil && (p.Count < 1 || p.Parallelism < 0 || options.Extraction.HeadBytes > 0) {
+		return nil, nil, nil, fmt.Errorf("invalid pages: count must be positive and headBytes can not be used")
+	}
+	if p := options.Extraction.Pages; p != nil && maxPages > 0 && p.Count > maxPages {
+		return nil, nil, nil, fmt.Errorf("invalid pages: count %d, at most %d", p.Count, maxPages)
+	}
+	if p := options.Extraction.Pages; p != nil && maxPageParallelism > 0 && p.Parallelism > maxPageParallelism {
+		return nil, nil, nil, fmt.Errorf("invalid pages: parallelism %d, at most %d", p.Parallelism, maxPageParallelism)
+	}
+	if options.Extraction.BodyTemplate != nil && (body != "" || options.Extraction.GraphQL != nil) {
+		return nil, nil, nil, fmt.Errorf("bodyTemplate can not be used with body or graphql")
+	}
+	if raw := options.Extraction.RawBody; raw != nil {
+		if body != "" || options.Extraction.GraphQL != nil || options.Extraction.BodyTemplate != nil {
+			return nil, nil, nil, fmt.Errorf("rawBody can not be used with body, graphql or bodyTemplate")
+		}
+		if body, err = raw.decode(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if options.Extraction.ContentType != "" {
+		contentType = options.Extraction.ContentType
+	}
+
+	sourceFormat := strings.ToUpper(options.Loading.SourceFormat)
+	switch sourceFormat {
+	case "":
+		sourceFormat = "CSV"
+	case "CSV", "PARQUET", "AVRO", "NEWLINE_DELIMITED_JSON":
+	default:
+		return nil, nil, nil, fmt.Errorf("invalid sourceFormat: %q", options.Loading.SourceFormat)
+	}
 
+	if options.Loading.ChunkRows < 0 || options.Loading.ChunkRows > 0 && sourceFormat != "CSV" {
+		return nil, nil, nil, fmt.Errorf("invalid chunkRows: %d", options.Loading.ChunkRows)
+	}
+	if options.Loading.PartitionColumn != "" && (sourceFormat != "CSV" || options.Loading.ChunkRows > 0) {
+		return nil, nil, nil, fmt.Errorf("partitionColumn can not be used with sourceFormat %s or chunkRows", sourceFormat)
+	}
+	if eav := options.Loading.EAV; eav != nil {
+		if len(eav.Core) == 0 || eav.Object == "" {
+			return nil, nil, nil, fmt.Errorf("eav: core and object are required")
+		}
+		if sourceFormat != "CSV" || options.Loading.ChunkRows > 0 || options.Loading.PartitionColumn != "" {
+			return nil, nil, nil, fmt.Errorf("eav can not be used with sourceFormat %s, chunkRows or partitionColumn", sourceFormat)
+		}
+	}
+	if options.Loading.MinRows < 0 || options.Loading.MinRows > 0 && (sourceFormat != "CSV" || options.Loading.ChunkRows > 0 || options.Loading.PartitionColumn != "" || options.Loading.EAV != nil) {
+		return nil, nil, nil, fmt.Errorf("invalid minRows: %d, it can not be used with sourceFormat %s, chunkRows, partitionColumn or eav", options.Loading.MinRows, sourceFormat)
+	}
+	if len(options.Loading.ExpectedColumns) > 0 && sourceFormat != "CSV" {
+		return nil, nil, nil, fmt.Errorf("expectedColumns can not be used with sourceFormat %s", sourceFormat)
+	}
+	maxColumns := options.Loading.MaxColumns
+	if maxColumns < 0 {
+		return nil, nil, nil, fmt.Errorf("invalid maxColumns: %d", maxColumns)
+	}
+	if maxColumns == 0 {
+		maxColumns = 10000
+	}
+	maxPartitions := 100
+	if p := options.Loading.MaxPartitions; p != nil {
+		if *p < 1 {
+			return nil, nil, nil, fmt.Errorf("invalid maxPartitions: %d", *p)
+		}
+		maxPartitions = *p
+	}
+	var partitionPattern *regexp.Regexp
+	if v := options.Loading.PartitionPattern; v != "" {
+		if options.Loading.PartitionColumn == "" {
+			return nil, nil, nil, fmt.Errorf("partitionPattern requires partitionColumn")
+		}
+		var err error
+		if partitionPattern, err = regexp.Compile(v); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid partitionPattern: %v", err)
+		}
+	}
+
+	stage := func(t Tweaker) Tweaker {
+		if options.Pipeline {
+			return PipelinedTweaker{t}
+		}
+		return t
+	}
 	var tweakers []Tweaker
 	if isZip {
-		tweakers = append(tweakers, ZipFileOpener{})
+		tweakers = append(tweakers, stage(ZipFileOpener{}))
 	}
 	if strings.ToLower(strings.TrimSpace(label)) != "utf-8" {
-		tweakers = append(tweakers, CharsetConverter{label})
+		tweakers = append(tweakers, stage(CharsetConverter{label: label}))
 	}
+	if len(options.Tweaks) > maxTweaks {
+		return nil, nil, nil, fmt.Errorf("too many tweaks: %d, at most %d", len(options.Tweaks), maxTweaks)
+	}
+
+	extractor := &HTTPExtractor{
+		method:          method,
+		url:             url,
+		body:            body,
+		preflight:       options.Extraction.Preflight,
+		maxBytes:        options.Extraction.MaxBytes,
+		headers:         options.Extraction.Headers,
+		oauth2:          options.Extraction.OAuth2,
+		sftp:            options.Extraction.SFTP,
+		mirrors:         options.Extraction.Mirrors,
+		headBytes:       options.Extraction.HeadBytes,
+		noCache:         options.Extraction.Cache != nil && !*options.Extraction.Cache,
+		contentType:     contentType,
+		bodyTemplate:    options.Extraction.BodyTemplate,
+		tls:             options.Extraction.TLS,
+		pages:           options.Extraction.Pages,
+		responseHeaders: options.Extraction.ResponseHeaders,
+	}
+	for _, t := range options.Tweaks {
+		tweaker, err := newTweaker(t, start)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if t.When != nil {
+			tweaker = &ConditionalTweaker{when: *t.When, tweaker: tweaker, metadata: &extractor.metadata}
+		}
+		tweaker = stage(tweaker)
+		switch t.OnError {
+		case "", "fail":
+		case "skip":
+			tweaker = &SkippableTweaker{call: t.Call, tweaker: tweaker}
+		default:
+			return nil, nil, nil, fmt.Errorf("%s: invalid onError: %q", t.Call, t.OnError)
+		}
+		tweakers = append(tweakers, tweaker)
+	}
+	loader := &CloudStorageLoader{
+		bucketName:             bucket,
+		objectName:             object,
+		noHeader:               options.Loading.NoHeader,
+		sourceFormat:           sourceFormat,
+		chunkRows:              options.Loading.ChunkRows,
+		partitionColumn:        options.Loading.PartitionColumn,
+		maxPartitions:          maxPartitions,
+		partitionPattern:       partitionPattern,
+		eav:                    options.Loading.EAV,
+		serviceAccount:         options.Loading.ServiceAccount,
+		maxColumns:             maxColumns,
+		schemaObject:           options.Loading.SchemaObject,
+		minRows:                options.Loading.MinRows,
+		expectedColumns:        options.Loading.ExpectedColumns,
+		expectedColumnsOrdered: options.Loading.ExpectedColumnsOrdered,
+	}
+	return extractor, tweakers, loader, nil
+}
 
-	return &HTTPExtractor{method, url, body}, tweakers, &CloudStorageLoader{bucket, object}, nil
+type GzipResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
 }
 
-func returnErrorMessage(w http.ResponseWriter, statusCode int, errorMessage error) {
-	data, err := json.Marshal(map[string]string{"errorMessage": errorMessage.Error()})
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	if err != nil {
-		fmt.Fprint(w, `{"errorMessage": "json.Marshal Failed"}`)
-		return
+func (w GzipResponseWriter) Write(p []byte) (int, error) { return w.w.Write(p) }
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, by
+// name or by *, with a nonzero q-value. A gzip entry takes precedence over *.
+func acceptsGzip(header string) bool {
+	star := false
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(k), "q") {
+				var err error
+				if q, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		switch coding {
+		case "gzip", "x-gzip":
+			return q > 0
+		case "*":
+			star = q > 0
+		}
 	}
-	fmt.Fprint(w, data)
+	return star
 }
 
 type Reply struct {
-	Header []string `json:"header"`
+	Header     []string    `json:"header"`
+	Objects    []string    `json:"objects,omitempty"`
+	Partitions []Partition `json:"partitions,omitempty"`
+	Chunks     []Chunk     `json:"chunks,omitempty"`
+	Schema     string      `json:"schema,omitempty"`
+	// SkippedTweaks are the calls of the tweaks skipped by onError.
+	SkippedTweaks []string `json:"skippedTweaks,omitempty"`
+	// ResponseHeaders are the selected headers of the extracted response.
+	ResponseHeaders map[string]string `json:"responseHeaders,omitempty"`
+}
+
+// process extracts, tweaks and loads one call, and returns the stage that
+// failed along with the error. A tweaker closes its input when it fails, and
+// closing the last stage stops the goroutines of the stages before it and
+// the response body, however far loading got.
+func process(call []any, start time.Time) (*Reply, string, error) {
+	extractor, tweakers, loader, err := parseCall(call, start)
+	if err != nil {
+		return nil, "parse", err
+	}
+	reader, err := extractor.Extract()
+	if errors.Is(err, errCircuitOpen) {
+		return nil, "unavailable", err
+	}
+	if err != nil {
+		return nil, "extract", err
+	}
+	for _, tweaker := range tweakers {
+		reader, err = tweaker.tweak(reader)
+		if err != nil {
+			return nil, "tweak", err
+		}
+		if reader == nil {
+			// An empty zip archive has nothing to open.
+			reader = io.NopCloser(strings.NewReader(""))
+		}
+	}
+	defer reader.Close()
+
+	reply, err := loader.load(reader)
+	if err != nil {
+		return nil, "load", err
+	}
+	for _, tweaker := range tweakers {
+		if s, ok := tweaker.(*SkippableTweaker); ok && s.skipped {
+			reply.SkippedTweaks = append(reply.SkippedTweaks, s.call)
+		}
+	}
+	if len(extractor.responseHeaders) > 0 {
+		reply.ResponseHeaders = extractor.metadata.selectHeaders(extractor.responseHeaders)
+	}
+	return reply, "", nil
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
+	if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		gw := gzip.NewWriter(w)
+		defer gw.Close()
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		w = GzipResponseWriter{w, gw}
+	}
 	if r.Method != http.MethodPost {
-		returnErrorMessage(w, http.StatusBadRequest, fmt.Errorf("method Not Allowed: %v", r.Method))
+		returnError(w, "request", fmt.Errorf("method Not Allowed: %v", r.Method))
 		return
 	}
+	start := time.Now()
 	var input Input
 
-	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-		returnErrorMessage(w, http.StatusBadRequest, fmt.Errorf("json.NewDecoder.Decode: %v", err))
+	// The header is checked before reading the body, and the secret in the
+	// body is used only without it.
+	secret := r.Header.Get("X-Tweakle-Secret")
+	if authSecret != "" && secret != "" && !authorized(secret) {
+		returnError(w, "auth", fmt.Errorf("invalid or missing secret"))
 		return
 	}
-
-	replies := make([]Reply, len(input.Calls))
-	for i, call := range input.Calls {
-		extractor, tweakers, loader, err := parseCall(call)
-		if err != nil {
-			returnErrorMessage(w, http.StatusBadGateway, err)
-			return
-		}
-		reader, err := extractor.Extract()
+	body := r.Body
+	if maxRequestBytes > 0 {
+		body = http.MaxBytesReader(w, body, maxRequestBytes)
+	}
+	if encoding := strings.TrimSpace(r.Header.Get("Content-Encoding")); strings.EqualFold(encoding, "gzip") || strings.EqualFold(encoding, "x-gzip") {
+		gr, err := gzip.NewReader(body)
 		if err != nil {
-			returnErrorMessage(w, http.StatusBadGateway, err)
+			returnError(w, "request", fmt.Errorf("gzip.NewReader: %v", err))
 			return
 		}
-		for _, tweaker := range tweakers {
-			reader, err = tweaker.tweak(reader)
-			if err != nil {
-				returnErrorMessage(w, http.StatusBadGateway, err)
-				return
-			}
-		}
-
-		header, err := loader.load(reader)
-		if err != nil {
-			returnErrorMessage(w, http.StatusBadGateway, err)
-			return
+		defer gr.Close()
+		body = gr
+		if maxRequestBytes > 0 {
+			body = http.MaxBytesReader(w, gr, maxRequestBytes)
 		}
+	}
+	if err := json.NewDecoder(body).Decode(&input); err != nil {
+		returnError(w, "request", fmt.Errorf("json.NewDecoder.Decode: %v", err))
+		return
+	}
+	if authSecret != "" && secret == "" && !authorized(input.UserDefinedContext["secret"]) {
+		returnError(w, "auth", fmt.Errorf("invalid or missing secret"))
+		return
+	}
 
+	replies := make([]Reply, len(input.Calls))
+	for i, call := range input.Calls {
+		reply, stage, err := process(call, start)
 		if err != nil {
-			returnErrorMessage(w, http.StatusBadGateway, err)
+			returnError(w, stage, err)
 			return
 		}
-		replies[i] = Reply{header}
+		replies[i] = *reply
 	}
 
 	data, err := json.Marshal(map[string][]Reply{"replies": replies})
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseCallPages(t *testing.T) {
+	defer func(pages, parallelism int) { maxPages, maxPageParallelism = pages, parallelism }(maxPages, maxPageParallelism)
+	maxPages, maxPageParallelism = 10, 4
+	tests := []struct {
+		options string
+		ok      bool
+	}{
+		{`{"extraction": {"pages": {"count": 10, "parallelism": 4}}}`, true},
+		{`{"extraction": {"pages": {"count": 0}}}`, false},
+		{`{"extraction": {"pages": {"count": 11}}}`, false},
+		{`{"extraction": {"pages": {"count": 1000000000000}}}`, false},
+		{`{"extraction": {"pages": {"count": 1, "parallelism": 5}}}`, false},
+	}
+	for _, tt := range tests {
+		_, _, _, err := parseCall([]any{"GET", "https://example.com/?page={page}", "", false, "utf-8", "bucket", "object.csv", tt.options}, time.Now())
+		if (err == nil) != tt.ok {
+			t.Errorf("parseCall(%s) error = %v, want ok %v", tt.options, err, tt.ok)
+		}
+	}
+}
+
+func TestExtractPagesParallelism(t *testing.T) {
+	defer func(parallelism int) { maxPageParallelism = parallelism }(maxPageParallelism)
+	maxPageParallelism = 2
+	var mu sync.Mutex
+	var running, peak int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		io.WriteString(w, "page\n"+r.URL.Query().Get("page")+"\n")
+	}))
+	defer ts.Close()
+
+	e := &HTTPExtractor{method: http.MethodGet, url: ts.URL + "/?page={page}", pages: &Pages{Count: 8}}
+	r, err := e.extractPages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "page\n1\n2\n3\n4\n5\n6\n7\n8\n"; string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+	if peak > 2 {
+		t.Errorf("%d pages fetched at a time, want at most 2", peak)
+	}
+}
+
+func TestNewErrorStatus(t *testing.T) {
+	tests := []struct {
+		errorStatus string
+		stage       string
+		want        int
+	}{
+		{"", "parse", http.StatusBadGateway},
+		{"", "request", http.StatusBadRequest},
+		{`{"parse": 400}`, "parse", http.StatusBadRequest},
+		{`{"parse": 400}`, "extract", http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Setenv("ERROR_STATUS", tt.errorStatus)
+		if got := newErrorStatus()[tt.stage]; got != tt.want {
+			t.Errorf("ERROR_STATUS=%q: %s = %d, want %d", tt.errorStatus, tt.stage, got, tt.want)
+		}
+	}
+}
+
+func TestParseCallMaxPartitions(t *testing.T) {
+	tests := []struct {
+		options string
+		want    int
+		ok      bool
+	}{
+		{`{"loading": {"partitionColumn": "c"}}`, 100, true},
+		{`{"loading": {"partitionColumn": "c", "maxPartitions": 5}}`, 5, true},
+		{`{"loading": {"partitionColumn": "c", "maxPartitions": 0}}`, 0, false},
+		{`{"loading": {"partitionColumn": "c", "maxPartitions": -1}}`, 0, false},
+	}
+	for _, tt := range tests {
+		_, _, loader, err := parseCall([]any{"GET", "https://example.com/", "", false, "utf-8", "bucket", "object.csv", tt.options}, time.Now())
+		if (err == nil) != tt.ok {
+			t.Errorf("parseCall(%s) error = %v, want ok %v", tt.options, err, tt.ok)
+		} else if tt.ok && loader.maxPartitions != tt.want {
+			t.Errorf("parseCall(%s): maxPartitions = %d, want %d", tt.options, loader.maxPartitions, tt.want)
+		}
+	}
+}
+
+func TestHandlerRequestBody(t *testing.T) {
+	defer func(n int64) { maxRequestBytes = n }(maxRequestBytes)
+	maxRequestBytes = 1000
+	gzipped := func(s string) string {
+		var b bytes.Buffer
+		gw := gzip.NewWriter(&b)
+		io.WriteString(gw, s)
+		gw.Close()
+		return b.String()
+	}
+	calls := `{"calls": []}`
+	large := `{"calls": []` + strings.Repeat(" ", 2000) + `}`
+	tests := []struct {
+		encoding string
+		body     string
+		want     int
+	}{
+		{"", calls, http.StatusOK},
+		{"gzip", gzipped(calls), http.StatusOK},
+		{"GZIP", gzipped(calls), http.StatusOK},
+		{"x-gzip", gzipped(calls), http.StatusOK},
+		{"", large, http.StatusBadRequest},
+		{"gzip", gzipped(large), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		if tt.encoding != "" {
+			r.Header.Set("Content-Encoding", tt.encoding)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("Content-Encoding %q, %d bytes: status = %d, want %d: %s", tt.encoding, len(tt.body), w.Code, tt.want, w.Body)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"x-gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip;q=1.0", true},
+		{"gzip;q=0.5", true},
+		{"gzip ; Q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip;q=0.000", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"gzip;q=0, *", false},
+		{"br, *;q=0.1", true},
+		{"identity", false},
+		{"gzip;q=abc", false},
+		{"gzip;q=", false},
+		{"gzip;q=-1", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestExtractionCache(t *testing.T) {
+	c := &extractionCache{ttl: time.Minute, maxBytes: 10, entries: map[string]*cacheEntry{}}
+	c.put("a", []byte("aaaa"), Metadata{})
+	c.put("b", []byte("bbbb"), Metadata{})
+	c.put("c", []byte("cccc"), Metadata{})
+	c.put("large", []byte("more than ten bytes"), Metadata{})
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"a", false},
+		{"b", true},
+		{"c", true},
+		{"large", false},
+	}
+	for _, tt := range tests {
+		if _, ok := c.get(tt.key); ok != tt.want {
+			t.Errorf("get(%q) ok = %v, want %v", tt.key, ok, tt.want)
+		}
+	}
+	if c.size != 8 {
+		t.Errorf("size = %d, want 8", c.size)
+	}
+
+	c.put("b", []byte("bb"), Metadata{})
+	if entry, ok := c.get("b"); !ok || string(entry.body) != "bb" {
+		t.Errorf("get(%q) after replacing it: %v, want %q", "b", entry, "bb")
+	}
+	if c.size != 6 {
+		t.Errorf("size after replacing b = %d, want 6", c.size)
+	}
+
+	c = &extractionCache{ttl: time.Millisecond, maxBytes: 10, entries: map[string]*cacheEntry{}}
+	c.put("a", []byte("aaaa"), Metadata{})
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.get("a"); ok {
+		t.Errorf("get(%q) returned an expired entry", "a")
+	}
+	c.put("b", []byte("bbbb"), Metadata{})
+	if _, ok := c.entries["a"]; ok || c.size != 4 {
+		t.Errorf("expired entry kept: size %d, want 4", c.size)
+	}
+}
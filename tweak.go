@@ -0,0 +1,3722 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"container/heap"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/nyaruka/phonenumbers"
+	"github.com/saintfish/chardet"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/encoding/charmap"
+	textunicode "golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/language"
+	"golang.org/x/text/transform"
+	"io"
+	"log"
+	"math/big"
+	"math/rand"
+	"mime"
+	"mime/quotedprintable"
+	neturl "net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type Tweak struct {
+	Call string            `json:"call"`
+	Args map[string]string `json:"args"`
+	When *When             `json:"when"`
+	// OnError is "fail" (default) or "skip" to continue without the tweak.
+	OnError string `json:"onError"`
+}
+
+// When is the condition for a tweak to run: all of the set fields match, or
+// with Not, any of them does not.
+type When struct {
+	// HeaderContains is a column name the header must have.
+	HeaderContains string `json:"headerContains"`
+	// ContentType is the media type of the response, e.g. text/csv.
+	ContentType string `json:"contentType"`
+	// Charset is the charset parameter of the response's Content-Type.
+	Charset string `json:"charset"`
+	Not     bool   `json:"not"`
+}
+
+// SkippableTweaker passes its input through unchanged when tweaker fails.
+// The input and the output are buffered to be able to do so.
+type SkippableTweaker struct {
+	call    string
+	tweaker Tweaker
+	skipped bool
+}
+
+func (t *SkippableTweaker) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	defer reader.Close()
+	input, err := bufferAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	output, err := func() (*spillBuffer, error) {
+		r, err := t.tweaker.tweak(io.NopCloser(input.reader()))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return bufferAll(r)
+	}()
+	if err != nil {
+		log.Printf("%s: skipped: %v", t.call, err)
+		t.skipped = true
+		output = input
+	} else {
+		input.Close()
+	}
+	return ChainedCloser{output.reader(), output}, nil
+}
+
+// PipelinedTweaker reads the output of tweaker on its own goroutine, so that
+// a stage that does its work in Read, such as charset conversion or
+// decompression, runs alongside the next one. Closing the output stops the
+// goroutine and closes the stages before it.
+type PipelinedTweaker struct {
+	tweaker Tweaker
+}
+
+func (t PipelinedTweaker) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	r, err := t.tweaker.tweak(reader)
+	if err != nil || r == nil {
+		return r, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer r.Close()
+		_, err := io.Copy(pw, r)
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// ConditionalTweaker runs tweaker only when the condition matches the
+// extracted response and the header of the stream at that point.
+type ConditionalTweaker struct {
+	when     When
+	tweaker  Tweaker
+	metadata *Metadata
+}
+
+func (t ConditionalTweaker) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	match := true
+	mediaType, params, _ := mime.ParseMediaType(t.metadata.ContentType)
+	if t.when.ContentType != "" && !strings.EqualFold(mediaType, t.when.ContentType) {
+		match = false
+	}
+	if t.when.Charset != "" && !strings.EqualFold(params["charset"], t.when.Charset) {
+		match = false
+	}
+	if t.when.HeaderContains != "" {
+		br := bufio.NewReader(reader)
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			reader.Close()
+			return nil, err
+		}
+		reader = ChainedCloser{io.MultiReader(strings.NewReader(line), br), reader}
+		cr := csv.NewReader(strings.NewReader(strings.TrimPrefix(line, "\ufeff")))
+		cr.LazyQuotes = true
+		header, _ := cr.Read()
+		if _, err := columnIndex(header, t.when.HeaderContains); err != nil {
+			match = false
+		}
+	}
+	if match == t.when.Not {
+		return reader, nil
+	}
+	return t.tweaker.tweak(reader)
+}
+
+func newTweaker(t Tweak, start time.Time) (Tweaker, error) {
+	switch t.Call {
+	case "addcolumn":
+		return newColumnAdder(t.Args, start)
+	case "urldecode":
+		return newURLDecoder(t.Args)
+	case "lookup":
+		return newLookupJoiner(t.Args)
+	case "mask":
+		return newMasker(t.Args)
+	case "whitespace2csv":
+		return newWhitespaceSplitter(t.Args)
+	case "fixquotes":
+		return newQuoteFixer(t.Args)
+	case "asciifold":
+		return &ASCIIFolder{t.Args["columns"]}, nil
+	case "pivot":
+		return newPivoter(t.Args)
+	case "kv-pivot":
+		return newKVPivoter(t.Args)
+	case "qp-decode":
+		switch t.Args["mode"] {
+		case "":
+			return QPDecoder{}, nil
+		case "words":
+			return QPDecoder{words: true}, nil
+		default:
+			return nil, fmt.Errorf("qp-decode: invalid mode: %q", t.Args["mode"])
+		}
+	case "sample":
+		return newRowSampler(t.Args)
+	case "sort":
+		return newRowSorter(t.Args)
+	case "ffill":
+		if t.Args["columns"] == "" {
+			return nil, fmt.Errorf("ffill: columns is required")
+		}
+		return &ForwardFiller{t.Args["columns"], t.Args["group"]}, nil
+	case "aggregate":
+		return newAggregator(t.Args)
+	case "html-table":
+		return newHTMLTableExtractor(t.Args)
+	case "skipfooter":
+		n, err := strconv.Atoi(t.Args["n"])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("skipfooter: invalid n: %q", t.Args["n"])
+		}
+		return &FooterSkipper{n}, nil
+	case "drop-empty":
+		return EmptyRowDropper{trimSpace: t.Args["whitespace"] == "true", keepQuoted: t.Args["keep_quoted"] == "true"}, nil
+	case "dropheaders":
+		return HeaderDropper{}, nil
+	case "convert":
+		c := CharsetConverter{label: t.Args["charset"], sniffBOM: true, detect: t.Args["charset"] == "auto"}
+		if v := t.Args["fallbacks"]; v != "" {
+			for _, label := range strings.Split(v, ",") {
+				c.fallbacks = append(c.fallbacks, strings.TrimSpace(label))
+			}
+		}
+		return &c, nil
+	case "fix-mojibake":
+		return MojibakeFixer{}, nil
+	case "flatten-newlines":
+		token, ok := t.Args["token"]
+		if !ok {
+			token = " "
+		}
+		return &NewlineFlattener{strings.NewReplacer("\r\n", token, "\n", token, "\r", token)}, nil
+	case "rownum":
+		r := RowNumberer{name: t.Args["name"], start: 1}
+		if r.name == "" {
+			r.name = "_row_number"
+		}
+		if v := t.Args["start"]; v != "" {
+			var err error
+			if r.start, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, fmt.Errorf("rownum: invalid start: %q", v)
+			}
+		}
+		return &r, nil
+	case "rowhash":
+		name, ok := t.Args["name"]
+		if !ok {
+			name = "_row_hash"
+		}
+		return &RowHasher{name: name, columns: t.Args["columns"]}, nil
+	case "forcequote":
+		return ForceQuoter{}, nil
+	case "repair-delimiter":
+		if t.Args["column"] == "" {
+			return nil, fmt.Errorf("repair-delimiter: column is required")
+		}
+		return &DelimiterRepairer{t.Args["column"]}, nil
+	case "replaceheader":
+		return newHeaderReplacer(t.Args)
+	case "dedupheader":
+		return HeaderDeduplicator{}, nil
+	case "coalesce-columns":
+		if len(strings.Split(t.Args["columns"], ",")) < 2 {
+			return nil, fmt.Errorf("coalesce-columns: at least two columns are required")
+		}
+		return &ColumnCoalescer{t.Args["columns"], t.Args["into"]}, nil
+	case "boolean":
+		return newBooleanCoercer(t.Args)
+	case "case":
+		return newCaseConverter(t.Args)
+	case "jsonarray2csv":
+		return &JSONArrayConverter{t.Args["columns"]}, nil
+	case "json-column":
+		if t.Args["columns"] == "" {
+			return nil, fmt.Errorf("json-column: columns is required")
+		}
+		onError, err := newFieldErrorPolicy("json-column", t.Args)
+		if err != nil {
+			return nil, err
+		}
+		return &JSONColumnValidator{t.Args["columns"], onError}, nil
+	case "flatten-json":
+		return newJSONFlattener(t.Args)
+	case "inject":
+		return newRowInjector(t.Args)
+	case "unzip-walk":
+		pattern, ok := t.Args["glob"]
+		if !ok {
+			pattern = "*"
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("unzip-walk: invalid glob: %q", pattern)
+		}
+		return &ZipWalker{pattern}, nil
+	case "split-name":
+		return newNameSplitter(t.Args)
+	case "squeeze-space":
+		return &SpaceSqueezer{t.Args["columns"]}, nil
+	case "strip-affix":
+		s := AffixStripper{columns: t.Args["column"], prefix: t.Args["prefix"], suffix: t.Args["suffix"]}
+		if s.columns == "" {
+			return nil, fmt.Errorf("strip-affix: column is required")
+		}
+		return &s, nil
+	case "numformat":
+		return newNumberNormalizer(t.Args)
+	case "round":
+		return newDecimalRounder(t.Args)
+	case "normalize-phone":
+		return newPhoneNormalizer(t.Args)
+	case "regexreplace":
+		return newRegexReplacer(t.Args)
+	case "truncate-field":
+		n, err := strconv.Atoi(t.Args["max"])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("truncate-field: invalid max: %q", t.Args["max"])
+		}
+		return &FieldTruncator{t.Args["columns"], n}, nil
+	case "typecast":
+		return newTypeCaster(t.Args)
+	case "to-utc":
+		return newUTCConverter(t.Args)
+	case "epoch2datetime":
+		return newEpochConverter(t.Args)
+	case "reformatdate":
+		return newDateReformatter(t.Args)
+	case "shapecheck":
+		switch t.Args["on_error"] {
+		case "", "drop":
+			return ShapeChecker{false}, nil
+		case "fail":
+			return ShapeChecker{true}, nil
+		default:
+			return nil, fmt.Errorf("shapecheck: invalid on_error: %q", t.Args["on_error"])
+		}
+	default:
+		return nil, fmt.Errorf("unknown tweak: %q", t.Call)
+	}
+}
+
+type emitFunc func(record []string) error
+
+// csvEditor rewrites a CSV stream record by record. header receives the first
+// record and record every following one; either may emit any number of
+// records in its place. flush is called once after the last record, and close
+// when editing ends, however it ends.
+type csvEditor struct {
+	header func(record []string, emit emitFunc) error
+	record func(record []string, emit emitFunc) error
+	flush  func(emit emitFunc) error
+	close  func()
+}
+
+func columnIndex(header []string, name string) (int, error) {
+	for i, h := range header {
+		if h == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("column not found: %q", name)
+}
+
+// columnIndexes resolves a comma separated list of column names.
+func columnIndexes(header []string, names string) ([]int, error) {
+	var indexes []int
+	for _, name := range strings.Split(names, ",") {
+		i, err := columnIndex(header, strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes, nil
+}
+
+// sniffBOM decodes r by its byte order mark, for when no given charset label
+// is known. It returns err when r has no byte order mark.
+func sniffBOM(r io.Reader, err error) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	bom, _ := br.Peek(3)
+	switch {
+	case bytes.HasPrefix(bom, []byte{0xEF, 0xBB, 0xBF}):
+		return br, nil
+	case bytes.HasPrefix(bom, []byte{0xFE, 0xFF}), bytes.HasPrefix(bom, []byte{0xFF, 0xFE}):
+		d := textunicode.UTF16(textunicode.BigEndian, textunicode.ExpectBOM).NewDecoder()
+		return transform.NewReader(br, d), nil
+	default:
+		return nil, err
+	}
+}
+
+// detectBytes is how much of the data the charset detector looks at.
+const detectBytes = 8 * 1024
+
+// detectCharset returns the most likely supported charset of sample. When
+// candidates is not empty, only those are considered and the first one is the
+// default; otherwise the default is UTF-8.
+func detectCharset(sample []byte, candidates []string) string {
+	allowed := map[string]bool{}
+	for _, label := range candidates {
+		if _, name := charset.Lookup(label); name != "" {
+			allowed[name] = true
+		}
+	}
+	results, err := chardet.NewTextDetector().DetectAll(sample)
+	if err != nil {
+		log.Printf("Detector.DetectAll: %v", err)
+	}
+	for _, r := range results {
+		_, name := charset.Lookup(r.Charset)
+		if name != "" && (len(candidates) == 0 || allowed[name]) {
+			return name
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates[0]
+	}
+	return "utf-8"
+}
+
+// fieldErrorPolicy decides what happens to a field that cannot be converted:
+// "fail" aborts the pipeline, "keep" leaves the field unchanged and "empty"
+// blanks it.
+type fieldErrorPolicy string
+
+func newFieldErrorPolicy(call string, args map[string]string) (fieldErrorPolicy, error) {
+	switch v := args["on_error"]; v {
+	case "":
+		return "fail", nil
+	case "fail", "keep", "empty":
+		return fieldErrorPolicy(v), nil
+	default:
+		return "", fmt.Errorf("%s: invalid on_error: %q", call, v)
+	}
+}
+
+func (p fieldErrorPolicy) handle(call string, value string, err error) (string, error) {
+	switch p {
+	case "keep":
+		return value, nil
+	case "empty":
+		return "", nil
+	default:
+		return "", fmt.Errorf("%s: %v", call, err)
+	}
+}
+
+// field returns record[i], or an empty string for a short record.
+func field(record []string, i int) string {
+	if i < len(record) {
+		return record[i]
+	}
+	return ""
+}
+
+// editLines rewrites a stream line by line. Lines are passed to edit without
+// their line ending, which is written back after the edited line.
+func editLines(reader io.ReadCloser, edit func(line string) (string, error)) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer reader.Close()
+		br := bufio.NewReader(reader)
+		pw.CloseWithError(func() error {
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil && err != io.EOF {
+					return err
+				}
+				if line == "" {
+					return nil
+				}
+				content := strings.TrimRight(line, "\r\n")
+				edited, err2 := edit(content)
+				if err2 != nil {
+					return err2
+				}
+				if _, err2 := io.WriteString(pw, edited+line[len(content):]); err2 != nil {
+					return err2
+				}
+				if err == io.EOF {
+					return nil
+				}
+			}
+		}())
+	}()
+	return pr
+}
+
+// writeCSV runs write on its own goroutine and streams the records it emits
+// as CSV. reader is closed when write returns.
+func writeCSV(reader io.ReadCloser, write func(emit emitFunc) error) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer reader.Close()
+		cw := csv.NewWriter(pw)
+		emit := func(record []string) error { return cw.Write(record) }
+		pw.CloseWithError(func() error {
+			if err := write(emit); err != nil {
+				return err
+			}
+			cw.Flush()
+			return cw.Error()
+		}())
+	}()
+	return pr
+}
+
+func (e csvEditor) edit(reader io.ReadCloser) io.ReadCloser {
+	return writeCSV(reader, func(emit emitFunc) error {
+		if e.close != nil {
+			defer e.close()
+		}
+		cr := csv.NewReader(reader)
+		cr.LazyQuotes = true
+		cr.FieldsPerRecord = -1
+		for i := 0; ; i++ {
+			record, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			f := e.record
+			if i == 0 && e.header != nil {
+				f = e.header
+			}
+			if f == nil {
+				err = emit(record)
+			} else {
+				err = f(record, emit)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if e.flush != nil {
+			return e.flush(emit)
+		}
+		return nil
+	})
+}
+
+type ColumnAdder struct {
+	name  string
+	value string
+}
+
+func newColumnAdder(args map[string]string, start time.Time) (*ColumnAdder, error) {
+	name, ok := args["name"]
+	if !ok {
+		name = "_loaded_at"
+	}
+	value, ok := args["value"]
+	if !ok {
+		value = "now"
+	}
+	if value == "now" {
+		format, ok := args["format"]
+		if !ok {
+			format = time.RFC3339
+		}
+		value = start.Format(format)
+	}
+	return &ColumnAdder{name, value}, nil
+}
+
+func (t ColumnAdder) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	return csvEditor{
+		header: func(record []string, emit emitFunc) error {
+			for _, h := range record {
+				if strings.EqualFold(h, t.name) {
+					return fmt.Errorf("addcolumn: column %q already exists", t.name)
+				}
+			}
+			return emit(append(record, t.name))
+		},
+		record: func(record []string, emit emitFunc) error {
+			return emit(append(record, t.value))
+		},
+	}.edit(reader), nil
+}
+
+type URLDecoder struct {
+	unescape func(s string) (string, error)
+}
+
+func newURLDecoder(args map[string]string) (*URLDecoder, error) {
+	switch args["mode"] {
+	case "", "query":
+		return &URLDecoder{neturl.QueryUnescape}, nil
+	case "path":
+		return &URLDecoder{neturl.PathUnescape}, nil
+	default:
+		return nil, fmt.Errorf("urldecode: invalid mode: %q", args["mode"])
+	}
+}
+
+func (t URLDecoder) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	return csvEditor{
+		header: func(record []string, emit emitFunc) error { return emit(record) },
+		record: func(record []string, emit emitFunc) error {
+			for i, field := range record {
+				// Fields with invalid escapes are left as they are.
+				if s, err := t.unescape(field); err == nil {
+					record[i] = s
+				}
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+type LookupJoiner struct {
+	url          string
+	key          string
+	value        string
+	on           string
+	name         string
+	defaultValue string
+}
+
+func newLookupJoiner(args map[string]string) (*LookupJoiner, error) {
+	t := LookupJoiner{
+		url:          args["url"],
+		key:          args["key"],
+		value:        args["value"],
+		on:           args["on"],
+		name:         args["name"],
+		defaultValue: args["default"],
+	}
+	if t.url == "" || t.key == "" || t.value == "" || t.on == "" {
+		return nil, fmt.Errorf("lookup: url, key, value and on are required")
+	}
+	if t.name == "" {
+		t.name = t.value
+	}
+	return &t, nil
+}
+
+func (t LookupJoiner) table() (map[string]string, error) {
+	res, err := httpClient.Get(t.url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode > 299 {
+		return nil, fmt.Errorf("lookup: response failed with status code: %d", res.StatusCode)
+	}
+	b, err := readAllLimited(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("lookup: %v", err)
+	}
+
+	cr := csv.NewReader(bytes.NewReader(b))
+	cr.LazyQuotes = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	k, err := columnIndex(header, t.key)
+	if err != nil {
+		return nil, fmt.Errorf("lookup: %v", err)
+	}
+	v, err := columnIndex(header, t.value)
+	if err != nil {
+		return nil, fmt.Errorf("lookup: %v", err)
+	}
+
+	table := map[string]string{}
+	buffered := bufferedBytes{call: "lookup"}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return table, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := buffered.addRow(record[k], record[v]); err != nil {
+			return nil, err
+		}
+		table[record[k]] = record[v]
+	}
+}
+
+func (t LookupJoiner) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	table, err := t.table()
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	var on int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) error {
+			on, err = columnIndex(record, t.on)
+			if err != nil {
+				return fmt.Errorf("lookup: %v", err)
+			}
+			return emit(append(record, t.name))
+		},
+		record: func(record []string, emit emitFunc) error {
+			value, ok := table[field(record, on)]
+			if !ok {
+				value = t.defaultValue
+			}
+			return emit(append(record, value))
+		},
+	}.edit(reader), nil
+}
+
+type Masker struct {
+	columns string
+	mask    func(s string) string
+}
+
+func newMasker(args map[string]string) (*Masker, error) {
+	columns := args["columns"]
+	if columns == "" {
+		return nil, fmt.Errorf("mask: columns is required")
+	}
+	switch args["method"] {
+	case "", "hash-sha256":
+		salt := args["salt"]
+		return &Masker{columns, func(s string) string {
+			sum := sha256.Sum256([]byte(salt + s))
+			return hex.EncodeToString(sum[:])
+		}}, nil
+	case "fixed":
+		value, ok := args["value"]
+		if !ok {
+			value = "***"
+		}
+		return &Masker{columns, func(s string) string { return value }}, nil
+	case "truncate":
+		length, err := strconv.Atoi(args["length"])
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("mask: invalid length: %q", args["length"])
+		}
+		return &Masker{columns, func(s string) string {
+			r := []rune(s)
+			if len(r) > length {
+				return string(r[:length])
+			}
+			return s
+		}}, nil
+	default:
+		return nil, fmt.Errorf("mask: invalid method: %q", args["method"])
+	}
+}
+
+func (t Masker) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			indexes, err = columnIndexes(record, t.columns)
+			if err != nil {
+				return fmt.Errorf("mask: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			for _, i := range indexes {
+				if i < len(record) {
+					record[i] = t.mask(record[i])
+				}
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+type WhitespaceSplitter struct {
+	min int
+}
+
+func newWhitespaceSplitter(args map[string]string) (*WhitespaceSplitter, error) {
+	min := 1
+	if v, ok := args["min"]; ok {
+		var err error
+		min, err = strconv.Atoi(v)
+		if err != nil || min < 1 {
+			return nil, fmt.Errorf("whitespace2csv: invalid min: %q", v)
+		}
+	}
+	return &WhitespaceSplitter{min}, nil
+}
+
+// split splits line on runs of at least t.min whitespace characters. A field
+// starting with a double quote extends to the closing quote.
+func (t WhitespaceSplitter) split(line string) []string {
+	r := []rune(line)
+	var fields []string
+	i := 0
+	for {
+		for i < len(r) && unicode.IsSpace(r[i]) {
+			i++
+		}
+		if i == len(r) {
+			return fields
+		}
+		var b strings.Builder
+		if r[i] == '"' {
+			for i++; i < len(r); i++ {
+				if r[i] == '"' {
+					if i+1 < len(r) && r[i+1] == '"' {
+						i++
+					} else {
+						i++
+						break
+					}
+				}
+				b.WriteRune(r[i])
+			}
+		}
+		for i < len(r) {
+			n := 0
+			for i+n < len(r) && unicode.IsSpace(r[i+n]) {
+				n++
+			}
+			if n >= t.min || i+n == len(r) {
+				i += n
+				break
+			}
+			b.WriteString(string(r[i : i+n+1]))
+			i += n + 1
+		}
+		fields = append(fields, b.String())
+	}
+}
+
+func (t WhitespaceSplitter) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	return editLines(reader, func(line string) (string, error) {
+		var b strings.Builder
+		cw := csv.NewWriter(&b)
+		if err := cw.Write(t.split(line)); err != nil {
+			return "", err
+		}
+		cw.Flush()
+		return strings.TrimSuffix(b.String(), "\n"), cw.Error()
+	}), nil
+}
+
+var (
+	doubledOpeningQuote = regexp.MustCompile(`(^|,)""([^",])`)
+	doubledClosingQuote = regexp.MustCompile(`([^",])""(,|$)`)
+)
+
+// quoteRepairs repair a single line of CSV.
+var quoteRepairs = map[string]func(line string) string{
+	// ""value"" -> "value"
+	"doubled": func(line string) string {
+		line = doubledOpeningQuote.ReplaceAllString(line, `$1"$2`)
+		return doubledClosingQuote.ReplaceAllString(line, `$1"$2`)
+	},
+	// \" -> ""
+	"backslash": func(line string) string {
+		return strings.ReplaceAll(line, `\"`, `""`)
+	},
+}
+
+type QuoteFixer struct {
+	repairs []func(line string) string
+}
+
+func newQuoteFixer(args map[string]string) (*QuoteFixer, error) {
+	names, ok := args["repair"]
+	if !ok {
+		names = "doubled"
+	}
+	var t QuoteFixer
+	for _, name := range strings.Split(names, ",") {
+		repair, ok := quoteRepairs[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("fixquotes: invalid repair: %q", name)
+		}
+		t.repairs = append(t.repairs, repair)
+	}
+	return &t, nil
+}
+
+func (t QuoteFixer) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	return editLines(reader, func(line string) (string, error) {
+		for _, repair := range t.repairs {
+			line = repair(line)
+		}
+		return line, nil
+	}), nil
+}
+
+// asciiPunctuation maps common non-ASCII punctuation to ASCII.
+var asciiPunctuation = map[rune]string{
+	'\u2018': "'", '\u2019': "'", '\u201A': "'", '\u201B': "'", '\u2032': "'",
+	'\u201C': `"`, '\u201D': `"`, '\u201E': `"`, '\u201F': `"`, '\u2033': `"`,
+	'\u2010': "-", '\u2011': "-", '\u2012': "-", '\u2013': "-", '\u2014': "-", '\u2015': "-", '\u2212': "-",
+	'\u2026': "...",
+	'\u00A0': " ", '\u2002': " ", '\u2003': " ", '\u2009': " ",
+}
+
+type ASCIIFolder struct {
+	columns string
+}
+
+func (t ASCIIFolder) fold(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if a, ok := asciiPunctuation[r]; ok {
+			b.WriteString(a)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func (t ASCIIFolder) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	if t.columns == "" {
+		return editLines(reader, func(line string) (string, error) { return t.fold(line), nil }), nil
+	}
+
+	var indexes []int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			indexes, err = columnIndexes(record, t.columns)
+			if err != nil {
+				return fmt.Errorf("asciifold: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			for _, i := range indexes {
+				if i < len(record) {
+					record[i] = t.fold(record[i])
+				}
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// Pivoter turns long rows into wide ones. All rows are buffered in memory
+// until the end of the stream, up to MAX_BUFFER_BYTES, and the number of
+// distinct keys is capped by maxKeys.
+type Pivoter struct {
+	index   string
+	key     string
+	value   string
+	maxKeys int
+}
+
+func newPivoter(args map[string]string) (*Pivoter, error) {
+	t := Pivoter{index: args["index"], key: args["key"], value: args["value"], maxKeys: 1000}
+	if t.index == "" || t.key == "" || t.value == "" {
+		return nil, fmt.Errorf("pivot: index, key and value are required")
+	}
+	if v, ok := args["maxkeys"]; ok {
+		var err error
+		t.maxKeys, err = strconv.Atoi(v)
+		if err != nil || t.maxKeys < 1 {
+			return nil, fmt.Errorf("pivot: invalid maxkeys: %q", v)
+		}
+	}
+	return &t, nil
+}
+
+func (t Pivoter) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	var key, value int
+	var keys []string
+	keyColumns := map[string]int{}
+	var rows [][]string
+	rowIndex := map[string]int{}
+	buffered := bufferedBytes{call: "pivot"}
+
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			indexes, err = columnIndexes(record, t.index)
+			if err != nil {
+				return fmt.Errorf("pivot: %v", err)
+			}
+			if key, err = columnIndex(record, t.key); err != nil {
+				return fmt.Errorf("pivot: %v", err)
+			}
+			if value, err = columnIndex(record, t.value); err != nil {
+				return fmt.Errorf("pivot: %v", err)
+			}
+			for _, i := range indexes {
+				keys = append(keys, record[i])
+			}
+			return nil
+		},
+		record: func(record []string, emit emitFunc) error {
+			var id []string
+			for _, i := range indexes {
+				id = append(id, field(record, i))
+			}
+			k := field(record, key)
+			column, ok := keyColumns[k]
+			if !ok {
+				if len(keyColumns) == t.maxKeys {
+					return fmt.Errorf("pivot: more than %d distinct keys", t.maxKeys)
+				}
+				if err := buffered.add(k); err != nil {
+					return err
+				}
+				column = len(keys)
+				keyColumns[k] = column
+				keys = append(keys, k)
+			}
+			joined := strings.Join(id, "\x00")
+			r, ok := rowIndex[joined]
+			if !ok {
+				if err := buffered.addRow(id...); err != nil {
+					return err
+				}
+				r = len(rows)
+				rowIndex[joined] = r
+				rows = append(rows, id)
+			}
+			for len(rows[r]) <= column {
+				rows[r] = append(rows[r], "")
+			}
+			rows[r][column] = field(record, value)
+			return buffered.add(rows[r][column])
+		},
+		flush: func(emit emitFunc) error {
+			if err := emit(keys); err != nil {
+				return err
+			}
+			for _, row := range rows {
+				for len(row) < len(keys) {
+					row = append(row, "")
+				}
+				if err := emit(row); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}.edit(reader), nil
+}
+
+// KVPivoter spreads (id, attribute, value) rows into one row per id with a
+// column per attribute. With attrs, the columns are known up front and only
+// the rows of the current id are buffered, so the rows of an id must be
+// consecutive; otherwise all rows are buffered until the end of the stream and
+// the number of distinct attributes is capped by maxAttrs. Either way the
+// buffered data is capped by MAX_BUFFER_BYTES.
+type KVPivoter struct {
+	id       string
+	attr     string
+	value    string
+	attrs    []string
+	maxAttrs int
+}
+
+func newKVPivoter(args map[string]string) (*KVPivoter, error) {
+	t := KVPivoter{id: args["id"], attr: args["attr"], value: args["value"], maxAttrs: 1000}
+	if t.id == "" || t.attr == "" || t.value == "" {
+		return nil, fmt.Errorf("kv-pivot: id, attr and value are required")
+	}
+	if v := args["attrs"]; v != "" {
+		t.attrs = strings.Split(v, ",")
+	}
+	if v, ok := args["maxattrs"]; ok {
+		var err error
+		t.maxAttrs, err = strconv.Atoi(v)
+		if err != nil || t.maxAttrs < 1 {
+			return nil, fmt.Errorf("kv-pivot: invalid maxattrs: %q", v)
+		}
+	}
+	return &t, nil
+}
+
+func (t KVPivoter) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var id, attr, value int
+	header := []string{t.id}
+	columns := map[string]int{}
+	for _, a := range t.attrs {
+		if _, ok := columns[a]; ok {
+			reader.Close()
+			return nil, fmt.Errorf("kv-pivot: duplicate attribute: %q", a)
+		}
+		columns[a] = len(header)
+		header = append(header, a)
+	}
+	var rows [][]string
+	rowIndex := map[string]int{}
+	// done holds the ids already emitted when streaming with attrs.
+	done := map[string]bool{}
+	// buffered counts every id, which stays in done when streaming, and the
+	// values only when all rows are buffered.
+	buffered := bufferedBytes{call: "kv-pivot"}
+	emitRows := func(emit emitFunc) error {
+		for _, row := range rows {
+			for len(row) < len(header) {
+				row = append(row, "")
+			}
+			if err := emit(row); err != nil {
+				return err
+			}
+			done[row[0]] = true
+		}
+		rows, rowIndex = nil, map[string]int{}
+		return nil
+	}
+
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			if id, err = columnIndex(record, t.id); err != nil {
+				return fmt.Errorf("kv-pivot: %v", err)
+			}
+			if attr, err = columnIndex(record, t.attr); err != nil {
+				return fmt.Errorf("kv-pivot: %v", err)
+			}
+			if value, err = columnIndex(record, t.value); err != nil {
+				return fmt.Errorf("kv-pivot: %v", err)
+			}
+			if t.attrs != nil {
+				return emit(header)
+			}
+			return nil
+		},
+		record: func(record []string, emit emitFunc) error {
+			a := field(record, attr)
+			column, ok := columns[a]
+			if !ok {
+				if t.attrs != nil {
+					return fmt.Errorf("kv-pivot: unknown attribute: %q", a)
+				}
+				if len(columns) == t.maxAttrs {
+					return fmt.Errorf("kv-pivot: more than %d distinct attributes", t.maxAttrs)
+				}
+				if err := buffered.add(a); err != nil {
+					return err
+				}
+				column = len(header)
+				columns[a] = column
+				header = append(header, a)
+			}
+			k := field(record, id)
+			r, ok := rowIndex[k]
+			if !ok {
+				if t.attrs != nil {
+					if done[k] {
+						return fmt.Errorf("kv-pivot: rows of id %q are not consecutive", k)
+					}
+					if err := emitRows(emit); err != nil {
+						return err
+					}
+				}
+				if err := buffered.addRow(k); err != nil {
+					return err
+				}
+				r = len(rows)
+				rowIndex[k] = r
+				rows = append(rows, []string{k})
+			}
+			for len(rows[r]) <= column {
+				rows[r] = append(rows[r], "")
+			}
+			rows[r][column] = field(record, value)
+			if t.attrs == nil {
+				return buffered.add(rows[r][column])
+			}
+			return nil
+		},
+		flush: func(emit emitFunc) error {
+			if t.attrs == nil {
+				if err := emit(header); err != nil {
+					return err
+				}
+			}
+			return emitRows(emit)
+		},
+	}.edit(reader), nil
+}
+
+// ForwardFiller carries the last non-empty value of a column down into the
+// empty cells below it, starting over whenever the value of the group column
+// changes.
+type ForwardFiller struct {
+	columns string
+	group   string
+}
+
+func (t ForwardFiller) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	group := -1
+	var last []string
+	var groupValue string
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			if indexes, err = columnIndexes(record, t.columns); err != nil {
+				return fmt.Errorf("ffill: %v", err)
+			}
+			if t.group != "" {
+				if group, err = columnIndex(record, t.group); err != nil {
+					return fmt.Errorf("ffill: %v", err)
+				}
+			}
+			last = make([]string, len(indexes))
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			// An empty group cell continues the group, as in a merged cell.
+			if group >= 0 {
+				if v := field(record, group); strings.TrimSpace(v) != "" && v != groupValue {
+					groupValue = v
+					for j := range last {
+						last[j] = ""
+					}
+				}
+			}
+			for j, i := range indexes {
+				for len(record) <= i {
+					record = append(record, "")
+				}
+				if strings.TrimSpace(record[i]) == "" {
+					record[i] = last[j]
+				} else {
+					last[j] = record[i]
+				}
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// QPDecoder decodes a quoted-printable stream. With words, header-like lines
+// such as "Subject: =?UTF-8?B?...?=" have their RFC 2047 encoded words
+// decoded instead.
+type QPDecoder struct {
+	words bool
+}
+
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(label string, input io.Reader) (io.Reader, error) {
+		return charset.NewReaderLabel(label, input)
+	},
+}
+
+var headerLine = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*:.*=\?`)
+
+func (t QPDecoder) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	if !t.words {
+		return ChainedCloser{quotedprintable.NewReader(reader), reader}, nil
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer reader.Close()
+		br := bufio.NewReader(reader)
+		pw.CloseWithError(func() error {
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil && err != io.EOF {
+					return err
+				}
+				if line == "" {
+					return nil
+				}
+				// Quoted-printable lines decode on their own, a soft line
+				// break dropping the line ending.
+				if content := strings.TrimRight(line, "\r\n"); headerLine.MatchString(content) {
+					s, err := wordDecoder.DecodeHeader(content)
+					if err != nil {
+						return fmt.Errorf("qp-decode: %v", err)
+					}
+					if _, err := io.WriteString(pw, s+line[len(content):]); err != nil {
+						return err
+					}
+				} else if _, err := io.Copy(pw, quotedprintable.NewReader(strings.NewReader(line))); err != nil {
+					return fmt.Errorf("qp-decode: %v", err)
+				}
+				if err == io.EOF {
+					return nil
+				}
+			}
+		}())
+	}()
+	return pr, nil
+}
+
+// RowSorter sorts the data rows by columns in byte order, keeping the header
+// on top. The sort is stable. Rows are buffered in memory up to
+// MEMORY_BUDGET_BYTES; beyond it, sorted runs are spilled to temporary files
+// and merged at the end.
+type RowSorter struct {
+	by []sortKey
+}
+
+type sortKey struct {
+	column string
+	desc   bool
+}
+
+func newRowSorter(args map[string]string) (*RowSorter, error) {
+	if args["by"] == "" {
+		return nil, fmt.Errorf("sort: by is required")
+	}
+	var t RowSorter
+	for _, s := range strings.Split(args["by"], ",") {
+		k := sortKey{column: s}
+		if i := strings.LastIndexByte(s, ':'); i >= 0 {
+			switch s[i+1:] {
+			case "asc":
+				k.column = s[:i]
+			case "desc":
+				k.column, k.desc = s[:i], true
+			}
+		}
+		t.by = append(t.by, k)
+	}
+	return &t, nil
+}
+
+// sortRun is a spilled run of sorted rows.
+type sortRun struct {
+	file *os.File
+	dec  *gob.Decoder
+}
+
+// writeSortRun spills sorted rows to an unlinked temporary file.
+func writeSortRun(rows [][]string) (*sortRun, error) {
+	f, err := os.CreateTemp("", "tweakle-sort-")
+	if err != nil {
+		log.Printf("os.CreateTemp: %v", err)
+		return nil, err
+	}
+	os.Remove(f.Name())
+	bw := bufio.NewWriter(f)
+	enc := gob.NewEncoder(bw)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &sortRun{f, gob.NewDecoder(bufio.NewReader(f))}, nil
+}
+
+func (r *sortRun) next() ([]string, error) {
+	var row []string
+	err := r.dec.Decode(&row)
+	return row, err
+}
+
+// mergeHeap orders the head rows of the runs, breaking ties by run so that
+// the merge stays stable.
+type mergeHeap struct {
+	rows [][]string
+	runs []int
+	less func(a, b []string) bool
+}
+
+func (h *mergeHeap) Len() int { return len(h.rows) }
+func (h *mergeHeap) Less(i, j int) bool {
+	if h.less(h.rows[i], h.rows[j]) {
+		return true
+	}
+	return !h.less(h.rows[j], h.rows[i]) && h.runs[i] < h.runs[j]
+}
+func (h *mergeHeap) Swap(i, j int) {
+	h.rows[i], h.rows[j] = h.rows[j], h.rows[i]
+	h.runs[i], h.runs[j] = h.runs[j], h.runs[i]
+}
+func (h *mergeHeap) Push(x any) {}
+func (h *mergeHeap) Pop() any {
+	n := len(h.rows) - 1
+	h.rows, h.runs = h.rows[:n], h.runs[:n]
+	return nil
+}
+
+func (t RowSorter) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	var rows [][]string
+	var size int64
+	var runs []*sortRun
+	less := func(a, b []string) bool {
+		for j, i := range indexes {
+			x, y := field(a, i), field(b, i)
+			if x != y {
+				return (x < y) != t.by[j].desc
+			}
+		}
+		return false
+	}
+	sortRows := func() {
+		sort.SliceStable(rows, func(i, j int) bool { return less(rows[i], rows[j]) })
+	}
+	closeRuns := func() {
+		for _, r := range runs {
+			r.file.Close()
+		}
+	}
+
+	return csvEditor{
+		header: func(record []string, emit emitFunc) error {
+			for _, k := range t.by {
+				i, err := columnIndex(record, k.column)
+				if err != nil {
+					return fmt.Errorf("sort: %v", err)
+				}
+				indexes = append(indexes, i)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			rows = append(rows, record)
+			// Count the slice headers as well as the bytes of the fields.
+			size += 24
+			for _, f := range record {
+				size += int64(len(f)) + 16
+			}
+			switch {
+			case memoryBudget > 0 && size > memoryBudget:
+				sortRows()
+				r, err := writeSortRun(rows)
+				if err != nil {
+					return err
+				}
+				runs = append(runs, r)
+				rows, size = nil, 0
+			case memoryBudget == 0 && maxBufferBytes > 0 && size > maxBufferBytes:
+				return fmt.Errorf("sort: buffered data exceeds MAX_BUFFER_BYTES %d", maxBufferBytes)
+			}
+			return nil
+		},
+		flush: func(emit emitFunc) error {
+			sortRows()
+			if len(runs) == 0 {
+				for _, row := range rows {
+					if err := emit(row); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			log.Printf("sort: merging %d runs spilled over MEMORY_BUDGET_BYTES %d", len(runs), memoryBudget)
+
+			// The rows still in memory are the last run.
+			next := func(run int) ([]string, error) {
+				if run < len(runs) {
+					return runs[run].next()
+				}
+				if len(rows) == 0 {
+					return nil, io.EOF
+				}
+				row := rows[0]
+				rows = rows[1:]
+				return row, nil
+			}
+			h := &mergeHeap{less: less}
+			for run := 0; run <= len(runs); run++ {
+				row, err := next(run)
+				if err == io.EOF {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				h.rows, h.runs = append(h.rows, row), append(h.runs, run)
+			}
+			heap.Init(h)
+			for h.Len() > 0 {
+				if err := emit(h.rows[0]); err != nil {
+					return err
+				}
+				row, err := next(h.runs[0])
+				if err == io.EOF {
+					heap.Pop(h)
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				h.rows[0] = row
+				heap.Fix(h, 0)
+			}
+			return nil
+		},
+		close: closeRuns,
+	}.edit(reader), nil
+}
+
+// RowSampler keeps each data row with probability rate. The same seed keeps
+// the same rows of the same input.
+type RowSampler struct {
+	rate float64
+	seed int64
+}
+
+func newRowSampler(args map[string]string) (*RowSampler, error) {
+	rate, err := strconv.ParseFloat(args["rate"], 64)
+	if err != nil || !(rate >= 0 && rate <= 1) {
+		return nil, fmt.Errorf("sample: invalid rate: %q", args["rate"])
+	}
+	t := RowSampler{rate: rate, seed: time.Now().UnixNano()}
+	if v := args["seed"]; v != "" {
+		if t.seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("sample: invalid seed: %q", v)
+		}
+	}
+	return &t, nil
+}
+
+func (t RowSampler) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	r := rand.New(rand.NewSource(t.seed))
+	return csvEditor{
+		header: func(record []string, emit emitFunc) error { return emit(record) },
+		record: func(record []string, emit emitFunc) error {
+			if r.Float64() < t.rate {
+				return emit(record)
+			}
+			return nil
+		},
+	}.edit(reader), nil
+}
+
+// FooterSkipper drops the last n rows. Rows are held back in a window of n
+// rows until it is known that they are not part of the footer.
+type FooterSkipper struct {
+	n int
+}
+
+func (t FooterSkipper) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var window [][]string
+	return csvEditor{
+		header: func(record []string, emit emitFunc) error { return emit(record) },
+		record: func(record []string, emit emitFunc) error {
+			window = append(window, record)
+			if len(window) <= t.n {
+				return nil
+			}
+			record, window = window[0], window[1:]
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// HeaderDropper drops rows that repeat the header, as left by concatenated
+// pages or files.
+type HeaderDropper struct{}
+
+func (t HeaderDropper) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var header []string
+	return csvEditor{
+		header: func(record []string, emit emitFunc) error {
+			header = append([]string(nil), record...)
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			if len(record) == len(header) {
+				same := true
+				for i := range record {
+					if record[i] != header[i] {
+						same = false
+						break
+					}
+				}
+				if same {
+					return nil
+				}
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+type CaseConverter struct {
+	columns string
+	caser   func() cases.Caser
+}
+
+func newCaseConverter(args map[string]string) (*CaseConverter, error) {
+	if args["columns"] == "" {
+		return nil, fmt.Errorf("case: columns is required")
+	}
+	tag := language.Und
+	if v, ok := args["lang"]; ok {
+		var err error
+		tag, err = language.Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("case: invalid lang: %q", v)
+		}
+	}
+	t := CaseConverter{columns: args["columns"]}
+	switch args["mode"] {
+	case "upper":
+		t.caser = func() cases.Caser { return cases.Upper(tag) }
+	case "lower":
+		t.caser = func() cases.Caser { return cases.Lower(tag) }
+	case "title":
+		t.caser = func() cases.Caser { return cases.Title(tag) }
+	default:
+		return nil, fmt.Errorf("case: invalid mode: %q", args["mode"])
+	}
+	return &t, nil
+}
+
+func (t CaseConverter) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	// A Caser is stateful, so each stream gets its own.
+	caser := t.caser()
+	var indexes []int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			indexes, err = columnIndexes(record, t.columns)
+			if err != nil {
+				return fmt.Errorf("case: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			for _, i := range indexes {
+				if i < len(record) {
+					record[i] = caser.String(record[i])
+				}
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// JSONArrayConverter converts a JSON array of objects to CSV, decoding one
+// element at a time. The columns default to the keys of the first object.
+type JSONArrayConverter struct {
+	columns string
+}
+
+// objectKeys returns the keys of a JSON object in document order.
+func objectKeys(raw json.RawMessage) ([]string, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	if tok, err := d.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("jsonarray2csv: expected object")
+	}
+	var keys []string
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, t.(string))
+		var v json.RawMessage
+		if err := d.Decode(&v); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// jsonString formats a decoded JSON value as a CSV field.
+func jsonString(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+}
+
+func (t JSONArrayConverter) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	return writeCSV(reader, func(emit emitFunc) error {
+		d := json.NewDecoder(reader)
+		d.UseNumber()
+		if tok, err := d.Token(); err != nil || tok != json.Delim('[') {
+			return fmt.Errorf("jsonarray2csv: expected array")
+		}
+
+		var columns []string
+		if t.columns != "" {
+			for _, c := range strings.Split(t.columns, ",") {
+				columns = append(columns, strings.TrimSpace(c))
+			}
+		}
+		for i := 0; d.More(); i++ {
+			var raw json.RawMessage
+			if err := d.Decode(&raw); err != nil {
+				return err
+			}
+			if columns == nil {
+				var err error
+				if columns, err = objectKeys(raw); err != nil {
+					return err
+				}
+			}
+			if i == 0 {
+				if err := emit(columns); err != nil {
+					return err
+				}
+			}
+
+			var object map[string]any
+			od := json.NewDecoder(bytes.NewReader(raw))
+			od.UseNumber()
+			if err := od.Decode(&object); err != nil {
+				return fmt.Errorf("jsonarray2csv: expected object: %v", err)
+			}
+			record := make([]string, len(columns))
+			for j, c := range columns {
+				s, err := jsonString(object[c])
+				if err != nil {
+					return err
+				}
+				record[j] = s
+			}
+			if err := emit(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}), nil
+}
+
+// JSONFlattener converts a JSON array or a stream of JSON objects, such as
+// newline delimited JSON, to CSV or newline delimited JSON with nested keys
+// joined by separator. Arrays are kept as JSON strings, or with index their
+// elements become keys numbered from 0.
+type JSONFlattener struct {
+	columns   string
+	separator string
+	index     bool
+	ndjson    bool
+}
+
+func newJSONFlattener(args map[string]string) (*JSONFlattener, error) {
+	t := JSONFlattener{columns: args["columns"], separator: "."}
+	if v, ok := args["separator"]; ok {
+		t.separator = v
+	}
+	switch args["arrays"] {
+	case "", "json":
+	case "index":
+		t.index = true
+	default:
+		return nil, fmt.Errorf("flatten-json: invalid arrays: %q", args["arrays"])
+	}
+	switch args["format"] {
+	case "", "csv":
+	case "ndjson":
+		t.ndjson = true
+	default:
+		return nil, fmt.Errorf("flatten-json: invalid format: %q", args["format"])
+	}
+	return &t, nil
+}
+
+// flatField is a leaf of a flattened object, both as a CSV field and as a
+// JSON value.
+type flatField struct {
+	key   string
+	value string
+	raw   json.RawMessage
+}
+
+// flatten appends the leaves of raw under prefix in document order.
+func (t JSONFlattener) flatten(fields []flatField, prefix string, raw json.RawMessage) ([]flatField, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + t.separator + key
+	}
+	switch raw[0] {
+	case '{':
+		d.Token()
+		for d.More() {
+			key, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			var v json.RawMessage
+			if err := d.Decode(&v); err != nil {
+				return nil, err
+			}
+			if fields, err = t.flatten(fields, join(key.(string)), v); err != nil {
+				return nil, err
+			}
+		}
+		return fields, nil
+	case '[':
+		if t.index {
+			var elements []json.RawMessage
+			if err := d.Decode(&elements); err != nil {
+				return nil, err
+			}
+			for i, v := range elements {
+				var err error
+				if fields, err = t.flatten(fields, join(strconv.Itoa(i)), v); err != nil {
+					return nil, err
+				}
+			}
+			return fields, nil
+		}
+		var b bytes.Buffer
+		if err := json.Compact(&b, raw); err != nil {
+			return nil, err
+		}
+		s, err := json.Marshal(b.String())
+		if err != nil {
+			return nil, err
+		}
+		return append(fields, flatField{prefix, b.String(), s}), nil
+	}
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	s, err := jsonString(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(fields, flatField{prefix, s, raw}), nil
+}
+
+// objects calls f with each object of a JSON array or of a stream of JSON
+// values.
+func (t JSONFlattener) objects(r io.Reader, f func(raw json.RawMessage) error) error {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err != nil || !unicode.IsSpace(rune(b[0])) {
+			break
+		}
+		br.Discard(1)
+	}
+	d := json.NewDecoder(br)
+	next := func() bool { return true }
+	if b, _ := br.Peek(1); len(b) == 1 && b[0] == '[' {
+		d.Token()
+		next = d.More
+	}
+	for next() {
+		var raw json.RawMessage
+		err := d.Decode(&raw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("flatten-json: %v", err)
+		}
+		if raw[0] != '{' {
+			return fmt.Errorf("flatten-json: expected object")
+		}
+		if err := f(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectFields returns the fields named columns, in that order.
+func selectFields(fields []flatField, columns []string) []flatField {
+	byKey := map[string]flatField{}
+	for _, f := range fields {
+		byKey[f.key] = f
+	}
+	selected := make([]flatField, len(columns))
+	for i, c := range columns {
+		f, ok := byKey[c]
+		if !ok {
+			f = flatField{c, "", json.RawMessage("null")}
+		}
+		selected[i] = f
+	}
+	return selected
+}
+
+func (t JSONFlattener) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var columns []string
+	if t.columns != "" {
+		for _, c := range strings.Split(t.columns, ",") {
+			columns = append(columns, strings.TrimSpace(c))
+		}
+	}
+	if !t.ndjson {
+		return writeCSV(reader, func(emit emitFunc) error {
+			return t.objects(reader, func(raw json.RawMessage) error {
+				fields, err := t.flatten(nil, "", raw)
+				if err != nil {
+					return fmt.Errorf("flatten-json: %v", err)
+				}
+				if columns == nil {
+					columns = []string{}
+					for _, f := range fields {
+						columns = append(columns, f.key)
+					}
+					if err := emit(columns); err != nil {
+						return err
+					}
+				}
+				record := make([]string, len(columns))
+				for i, f := range selectFields(fields, columns) {
+					record[i] = f.value
+				}
+				return emit(record)
+			})
+		}), nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer reader.Close()
+		bw := bufio.NewWriter(pw)
+		pw.CloseWithError(func() error {
+			err := t.objects(reader, func(raw json.RawMessage) error {
+				fields, err := t.flatten(nil, "", raw)
+				if err != nil {
+					return fmt.Errorf("flatten-json: %v", err)
+				}
+				if columns != nil {
+					fields = selectFields(fields, columns)
+				}
+				bw.WriteByte('{')
+				for i, f := range fields {
+					key, err := json.Marshal(f.key)
+					if err != nil {
+						return err
+					}
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					bw.Write(key)
+					bw.WriteByte(':')
+					bw.Write(f.raw)
+				}
+				_, err = bw.WriteString("}\n")
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			return bw.Flush()
+		}())
+	}()
+	return pr, nil
+}
+
+// JSONColumnValidator checks that columns hold JSON, for loading them into
+// JSON columns, and compacts the values onto one line.
+type JSONColumnValidator struct {
+	columns string
+	onError fieldErrorPolicy
+}
+
+func (t JSONColumnValidator) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			indexes, err = columnIndexes(record, t.columns)
+			if err != nil {
+				return fmt.Errorf("json-column: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			for _, i := range indexes {
+				if i >= len(record) || strings.TrimSpace(record[i]) == "" {
+					continue
+				}
+				var b bytes.Buffer
+				if err := json.Compact(&b, []byte(record[i])); err != nil {
+					s, err := t.onError.handle("json-column", record[i], fmt.Errorf("invalid JSON: %v", err))
+					if err != nil {
+						return err
+					}
+					record[i] = s
+					continue
+				}
+				record[i] = b.String()
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+type RowInjector struct {
+	top bool
+	row []string
+}
+
+func newRowInjector(args map[string]string) (*RowInjector, error) {
+	var t RowInjector
+	switch args["position"] {
+	case "top":
+		t.top = true
+	case "", "bottom":
+	default:
+		return nil, fmt.Errorf("inject: invalid position: %q", args["position"])
+	}
+
+	var err error
+	if t.row, err = parseRow(args["row"]); err != nil {
+		return nil, fmt.Errorf("inject: invalid row: %v", err)
+	}
+	return &t, nil
+}
+
+// parseRow parses a row given as a line of CSV or a JSON array of strings.
+func parseRow(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") {
+		var row []string
+		err := json.Unmarshal([]byte(s), &row)
+		return row, err
+	}
+	return csv.NewReader(strings.NewReader(s)).Read()
+}
+
+func (t RowInjector) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	row := func(emit emitFunc) error { return emit(append([]string(nil), t.row...)) }
+	return csvEditor{
+		header: func(record []string, emit emitFunc) error {
+			if len(record) != len(t.row) {
+				return fmt.Errorf("inject: row has %d columns, header has %d", len(t.row), len(record))
+			}
+			if err := emit(record); err != nil {
+				return err
+			}
+			if t.top {
+				return row(emit)
+			}
+			return nil
+		},
+		flush: func(emit emitFunc) error {
+			if !t.top {
+				return row(emit)
+			}
+			return nil
+		},
+	}.edit(reader), nil
+}
+
+// ShapeChecker drops, or fails on, rows whose number of fields differs from
+// the header.
+type ShapeChecker struct {
+	fail bool
+}
+
+func (t ShapeChecker) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	width, n, dropped := 0, 1, 0
+	return csvEditor{
+		header: func(record []string, emit emitFunc) error {
+			width = len(record)
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			n++
+			if len(record) == width {
+				return emit(record)
+			}
+			if t.fail {
+				return fmt.Errorf("shapecheck: record %d has %d fields, expected %d", n, len(record), width)
+			}
+			dropped++
+			return nil
+		},
+		flush: func(emit emitFunc) error {
+			if dropped > 0 {
+				log.Printf("shapecheck: dropped %d records", dropped)
+			}
+			return nil
+		},
+	}.edit(reader), nil
+}
+
+type DateReformatter struct {
+	columns string
+	from    string
+	to      string
+	onError fieldErrorPolicy
+}
+
+func newDateReformatter(args map[string]string) (*DateReformatter, error) {
+	t := DateReformatter{columns: args["column"], from: args["from"], to: args["to"]}
+	if t.columns == "" || t.from == "" {
+		return nil, fmt.Errorf("reformatdate: column and from are required")
+	}
+	if t.to == "" {
+		t.to = "2006-01-02"
+	}
+	var err error
+	t.onError, err = newFieldErrorPolicy("reformatdate", args)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (t DateReformatter) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			indexes, err = columnIndexes(record, t.columns)
+			if err != nil {
+				return fmt.Errorf("reformatdate: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			for _, i := range indexes {
+				if i >= len(record) || record[i] == "" {
+					continue
+				}
+				d, err := time.Parse(t.from, strings.TrimSpace(record[i]))
+				if err != nil {
+					if record[i], err = t.onError.handle("reformatdate", record[i], err); err != nil {
+						return err
+					}
+					continue
+				}
+				record[i] = d.Format(t.to)
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+type lastByteWriter struct {
+	w    io.Writer
+	last byte
+}
+
+func (w *lastByteWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		w.last = p[len(p)-1]
+	}
+	return w.w.Write(p)
+}
+
+// ZipWalker concatenates every archive entry matching pattern, in path order,
+// keeping only the first entry's header line. A pattern without a slash is
+// matched against the base name so that it applies at any depth.
+type ZipWalker struct {
+	pattern string
+}
+
+func (t ZipWalker) match(name string) bool {
+	if !strings.Contains(t.pattern, "/") {
+		name = path.Base(name)
+	}
+	ok, _ := path.Match(t.pattern, name)
+	return ok
+}
+
+func (t ZipWalker) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	b, err := bufferAll(reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	reader.Close()
+
+	r, err := zip.NewReader(b, b.size)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	var files []*zip.File
+	for _, f := range r.File {
+		if !f.FileInfo().IsDir() && t.match(f.Name) {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer b.Close()
+		pw.CloseWithError(func() error {
+			for i, f := range files {
+				rc, err := f.Open()
+				if err != nil {
+					return err
+				}
+				br := bufio.NewReader(rc)
+				if i > 0 {
+					if _, err := br.ReadString('\n'); err != nil && err != io.EOF {
+						rc.Close()
+						return err
+					}
+				}
+				w := &lastByteWriter{w: pw, last: '\n'}
+				_, err = io.Copy(w, br)
+				rc.Close()
+				if err != nil {
+					return err
+				}
+				// Make sure the next entry starts on a new line.
+				if w.last != '\n' {
+					if _, err := io.WriteString(pw, "\n"); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}())
+	}()
+	return pr, nil
+}
+
+type AffixStripper struct {
+	columns string
+	prefix  string
+	suffix  string
+}
+
+func (t AffixStripper) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			indexes, err = columnIndexes(record, t.columns)
+			if err != nil {
+				return fmt.Errorf("strip-affix: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			for _, i := range indexes {
+				if i < len(record) {
+					record[i] = strings.TrimSuffix(strings.TrimPrefix(record[i], t.prefix), t.suffix)
+				}
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+var plainNumber = regexp.MustCompile(`^[+-]?[0-9]+(\.[0-9]+)?$`)
+
+// NumberNormalizer rewrites numbers such as 1.234,56 to 1234.56.
+type NumberNormalizer struct {
+	columns   string
+	decimal   string
+	thousands string
+	onError   fieldErrorPolicy
+}
+
+func newNumberNormalizer(args map[string]string) (*NumberNormalizer, error) {
+	t := NumberNormalizer{columns: args["columns"], decimal: ".", thousands: ","}
+	if t.columns == "" {
+		return nil, fmt.Errorf("numformat: columns is required")
+	}
+	if v, ok := args["decimal"]; ok {
+		t.decimal = v
+	}
+	if v, ok := args["thousands"]; ok {
+		t.thousands = v
+	}
+	if t.decimal == "" || t.decimal == t.thousands {
+		return nil, fmt.Errorf("numformat: invalid decimal: %q", t.decimal)
+	}
+	var err error
+	if t.onError, err = newFieldErrorPolicy("numformat", args); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (t NumberNormalizer) normalize(s string) (string, error) {
+	n := strings.TrimSpace(s)
+	if t.thousands != "" {
+		n = strings.ReplaceAll(n, t.thousands, "")
+	}
+	n = strings.Replace(n, t.decimal, ".", 1)
+	if !plainNumber.MatchString(n) {
+		return "", fmt.Errorf("invalid number: %q", s)
+	}
+	return n, nil
+}
+
+func (t NumberNormalizer) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			indexes, err = columnIndexes(record, t.columns)
+			if err != nil {
+				return fmt.Errorf("numformat: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			for _, i := range indexes {
+				if i >= len(record) || strings.TrimSpace(record[i]) == "" {
+					continue
+				}
+				n, err := t.normalize(record[i])
+				if err != nil {
+					n, err = t.onError.handle("numformat", record[i], err)
+					if err != nil {
+						return err
+					}
+				}
+				record[i] = n
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// DecimalRounder rounds numbers to a fixed number of decimal places, halves
+// away from zero, without going through float64.
+type DecimalRounder struct {
+	columns string
+	places  int
+	onError fieldErrorPolicy
+}
+
+func newDecimalRounder(args map[string]string) (*DecimalRounder, error) {
+	t := DecimalRounder{columns: args["columns"]}
+	if t.columns == "" {
+		return nil, fmt.Errorf("round: columns is required")
+	}
+	var err error
+	if t.places, err = strconv.Atoi(args["places"]); err != nil || t.places < 0 {
+		return nil, fmt.Errorf("round: invalid places: %q", args["places"])
+	}
+	if t.onError, err = newFieldErrorPolicy("round", args); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (t DecimalRounder) round(s string) (string, error) {
+	n := strings.TrimSpace(s)
+	r, ok := new(big.Rat).SetString(n)
+	if !ok || !plainNumber.MatchString(n) {
+		return "", fmt.Errorf("invalid number: %q", s)
+	}
+	v := r.FloatString(t.places)
+	// -0.001 rounds to 0.00, not -0.00.
+	if strings.Trim(v, "-0.") == "" {
+		v = strings.TrimPrefix(v, "-")
+	}
+	return v, nil
+}
+
+func (t DecimalRounder) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			indexes, err = columnIndexes(record, t.columns)
+			if err != nil {
+				return fmt.Errorf("round: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			for _, i := range indexes {
+				if i >= len(record) || strings.TrimSpace(record[i]) == "" {
+					continue
+				}
+				n, err := t.round(record[i])
+				if err != nil {
+					n, err = t.onError.handle("round", record[i], err)
+					if err != nil {
+						return err
+					}
+				}
+				record[i] = n
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// HeaderDeduplicator renames duplicate header names, compared after
+// sanitizing and case insensitively as BigQuery does, by suffixing _1, _2,
+// ... in order.
+type HeaderDeduplicator struct{}
+
+func dedupNames(names []string) []string {
+	key := func(name string) string { return strings.ToLower(sanitizeColumnName(name)) }
+	seen := map[string]bool{}
+	for _, name := range names {
+		seen[key(name)] = false
+	}
+	deduped := make([]string, len(names))
+	for i, name := range names {
+		if !seen[key(name)] {
+			seen[key(name)] = true
+			deduped[i] = name
+			continue
+		}
+		for n := 1; ; n++ {
+			candidate := fmt.Sprintf("%s_%d", name, n)
+			if _, ok := seen[key(candidate)]; !ok {
+				seen[key(candidate)] = true
+				deduped[i] = candidate
+				break
+			}
+		}
+	}
+	return deduped
+}
+
+func (t HeaderDeduplicator) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	return csvEditor{
+		header: func(record []string, emit emitFunc) error { return emit(dedupNames(record)) },
+		record: func(record []string, emit emitFunc) error { return emit(record) },
+	}.edit(reader), nil
+}
+
+// NewlineFlattener replaces line breaks inside fields so that every record
+// is a single line.
+type NewlineFlattener struct {
+	replacer *strings.Replacer
+}
+
+func (t NewlineFlattener) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	return csvEditor{
+		record: func(record []string, emit emitFunc) error {
+			for i := range record {
+				record[i] = t.replacer.Replace(record[i])
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// RowHasher appends a SHA-256 fingerprint of the row, or of the given columns
+// for a business key. Fields are length-prefixed so that moving a character
+// between adjacent fields changes the hash.
+type RowHasher struct {
+	name    string
+	columns string
+}
+
+func (t RowHasher) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			for _, h := range record {
+				if strings.EqualFold(h, t.name) {
+					return fmt.Errorf("rowhash: column %q already exists", t.name)
+				}
+			}
+			if t.columns == "" {
+				indexes = make([]int, len(record))
+				for i := range record {
+					indexes[i] = i
+				}
+			} else if indexes, err = columnIndexes(record, t.columns); err != nil {
+				return fmt.Errorf("rowhash: %v", err)
+			}
+			return emit(append(record, t.name))
+		},
+		record: func(record []string, emit emitFunc) error {
+			h := sha256.New()
+			for _, i := range indexes {
+				v := field(record, i)
+				fmt.Fprintf(h, "%d:%s", len(v), v)
+			}
+			return emit(append(record, hex.EncodeToString(h.Sum(nil))))
+		},
+	}.edit(reader), nil
+}
+
+// Aggregator groups rows sharing the key columns into one row, aggregating
+// the other columns. All groups are kept in memory until the end of the
+// stream, up to MAX_BUFFER_BYTES, and their number is capped by maxGroups.
+type Aggregator struct {
+	keys      string
+	columns   []string
+	funcs     []string
+	maxGroups int
+}
+
+func newAggregator(args map[string]string) (*Aggregator, error) {
+	t := Aggregator{keys: args["keys"], maxGroups: 1000000}
+	if t.keys == "" || args["agg"] == "" {
+		return nil, fmt.Errorf("aggregate: keys and agg are required")
+	}
+	if v, ok := args["maxgroups"]; ok {
+		var err error
+		t.maxGroups, err = strconv.Atoi(v)
+		if err != nil || t.maxGroups < 1 {
+			return nil, fmt.Errorf("aggregate: invalid maxgroups: %q", v)
+		}
+	}
+	for _, a := range strings.Split(args["agg"], ",") {
+		column, f, ok := strings.Cut(strings.TrimSpace(a), ":")
+		switch f {
+		case "sum", "max", "min", "first", "last":
+		default:
+			ok = false
+		}
+		if !ok {
+			return nil, fmt.Errorf("aggregate: invalid agg: %q", a)
+		}
+		t.columns = append(t.columns, column)
+		t.funcs = append(t.funcs, f)
+	}
+	return &t, nil
+}
+
+// aggregate holds the state of one aggregated column of a group.
+type aggregate struct {
+	value string
+	num   *big.Rat
+	// scale is the most decimal places of the summed values.
+	scale int
+}
+
+func (t Aggregator) add(a *aggregate, f string, v string) error {
+	switch f {
+	case "first":
+		if a.num == nil {
+			a.num, a.value = new(big.Rat), v
+		}
+		return nil
+	case "last":
+		a.value = v
+		return nil
+	}
+	if v == "" {
+		return nil
+	}
+	// Rat also parses fractions such as 1/3, which are not numbers in CSV.
+	n, ok := new(big.Rat).SetString(v)
+	if !ok || !plainNumber.MatchString(v) {
+		return fmt.Errorf("aggregate: invalid number: %q", v)
+	}
+	switch f {
+	case "sum":
+		if a.num == nil {
+			a.num = new(big.Rat)
+		}
+		a.num.Add(a.num, n)
+		if i := strings.IndexByte(v, '.'); i >= 0 && len(v)-i-1 > a.scale {
+			a.scale = len(v) - i - 1
+		}
+		a.value = a.num.FloatString(a.scale)
+	case "max", "min":
+		if a.num == nil || f == "max" && n.Cmp(a.num) > 0 || f == "min" && n.Cmp(a.num) < 0 {
+			a.num, a.value = n, v
+		}
+	}
+	return nil
+}
+
+func (t Aggregator) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var keys, columns []int
+	var header []string
+	var groups [][]string
+	var states [][]aggregate
+	groupIndex := map[string]int{}
+	buffered := bufferedBytes{call: "aggregate"}
+
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			if keys, err = columnIndexes(record, t.keys); err != nil {
+				return fmt.Errorf("aggregate: %v", err)
+			}
+			for _, i := range keys {
+				header = append(header, record[i])
+			}
+			for _, c := range t.columns {
+				i, err := columnIndex(record, c)
+				if err != nil {
+					return fmt.Errorf("aggregate: %v", err)
+				}
+				columns = append(columns, i)
+				header = append(header, record[i])
+			}
+			return nil
+		},
+		record: func(record []string, emit emitFunc) error {
+			var key []string
+			for _, i := range keys {
+				key = append(key, field(record, i))
+			}
+			joined := strings.Join(key, "\x00")
+			g, ok := groupIndex[joined]
+			if !ok {
+				if len(groups) == t.maxGroups {
+					return fmt.Errorf("aggregate: more than %d groups", t.maxGroups)
+				}
+				if err := buffered.addRow(key...); err != nil {
+					return err
+				}
+				g = len(groups)
+				groupIndex[joined] = g
+				groups = append(groups, key)
+				states = append(states, make([]aggregate, len(columns)))
+			}
+			for j, i := range columns {
+				if err := t.add(&states[g][j], t.funcs[j], field(record, i)); err != nil {
+					return err
+				}
+				if !ok {
+					// The value of a group is counted as first seen.
+					if err := buffered.add(field(record, i)); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		flush: func(emit emitFunc) error {
+			if err := emit(header); err != nil {
+				return err
+			}
+			for g, key := range groups {
+				row := key
+				for _, a := range states[g] {
+					row = append(row, a.value)
+				}
+				if err := emit(row); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}.edit(reader), nil
+}
+
+// HTMLTableExtractor emits the rows of a <table> of an HTML page as CSV. The
+// table is the index-th (from 0) in document order, or the first matching
+// selector, which is either #id or .class.
+type HTMLTableExtractor struct {
+	index    int
+	selector string
+	// fillSpans repeats cells spanning several rows or columns; when false
+	// such cells are an error.
+	fillSpans bool
+}
+
+func newHTMLTableExtractor(args map[string]string) (*HTMLTableExtractor, error) {
+	t := HTMLTableExtractor{selector: args["selector"], fillSpans: true}
+	if v := args["index"]; v != "" {
+		var err error
+		t.index, err = strconv.Atoi(v)
+		if err != nil || t.index < 0 {
+			return nil, fmt.Errorf("html-table: invalid index: %q", v)
+		}
+	}
+	if t.selector != "" && !strings.HasPrefix(t.selector, "#") && !strings.HasPrefix(t.selector, ".") {
+		return nil, fmt.Errorf("html-table: invalid selector: %q", t.selector)
+	}
+	switch args["span"] {
+	case "", "fill":
+	case "error":
+		t.fillSpans = false
+	default:
+		return nil, fmt.Errorf("html-table: invalid span: %q", args["span"])
+	}
+	return &t, nil
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func (t HTMLTableExtractor) match(n *html.Node) bool {
+	switch {
+	case strings.HasPrefix(t.selector, "#"):
+		return htmlAttr(n, "id") == t.selector[1:]
+	case strings.HasPrefix(t.selector, "."):
+		for _, class := range strings.Fields(htmlAttr(n, "class")) {
+			if class == t.selector[1:] {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// find returns the table, counting the matching tables in document order.
+func (t HTMLTableExtractor) find(n *html.Node, count *int) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == atom.Table && t.match(n) {
+		if *count == t.index || t.selector != "" {
+			return n
+		}
+		*count++
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if table := t.find(c, count); table != nil {
+			return table
+		}
+	}
+	return nil
+}
+
+// htmlRows returns the rows of table, leaving out those of nested tables.
+func htmlRows(table *html.Node) []*html.Node {
+	var rows []*html.Node
+	for c := table.FirstChild; c != nil; c = c.NextSibling {
+		switch c.DataAtom {
+		case atom.Tr:
+			rows = append(rows, c)
+		case atom.Thead, atom.Tbody, atom.Tfoot:
+			rows = append(rows, htmlRows(c)...)
+		}
+	}
+	return rows
+}
+
+// htmlText returns the text of n with tags stripped and whitespace collapsed.
+// Nested tables are left out.
+func htmlText(n *html.Node) string {
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			b.WriteString(n.Data)
+		case n.DataAtom == atom.Br:
+			b.WriteString(" ")
+		case n.DataAtom == atom.Table:
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func htmlSpan(n *html.Node, key string) int {
+	span, err := strconv.Atoi(htmlAttr(n, key))
+	if err != nil || span < 1 {
+		return 1
+	}
+	return span
+}
+
+func (t HTMLTableExtractor) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	return writeCSV(reader, func(emit emitFunc) error {
+		b, err := readAllLimited(reader)
+		if err != nil {
+			return err
+		}
+		doc, err := html.Parse(bytes.NewReader(b))
+		if err != nil {
+			return fmt.Errorf("html-table: %v", err)
+		}
+		var count int
+		table := t.find(doc, &count)
+		if table == nil {
+			return fmt.Errorf("html-table: table not found")
+		}
+
+		// pending holds the cells of rows above that span into later rows.
+		type spanned struct {
+			text string
+			rows int
+		}
+		pending := map[int]*spanned{}
+		for _, tr := range htmlRows(table) {
+			var record []string
+			fill := func() {
+				for s := pending[len(record)]; s != nil; s = pending[len(record)] {
+					record = append(record, s.text)
+					if s.rows--; s.rows == 0 {
+						delete(pending, len(record)-1)
+					}
+				}
+			}
+			for td := tr.FirstChild; td != nil; td = td.NextSibling {
+				if td.DataAtom != atom.Td && td.DataAtom != atom.Th {
+					continue
+				}
+				fill()
+				text := htmlText(td)
+				rowspan, colspan := htmlSpan(td, "rowspan"), htmlSpan(td, "colspan")
+				if !t.fillSpans && (rowspan > 1 || colspan > 1) {
+					return fmt.Errorf("html-table: cell %q spans several rows or columns", text)
+				}
+				for i := 0; i < colspan; i++ {
+					if rowspan > 1 {
+						pending[len(record)] = &spanned{text, rowspan - 1}
+					}
+					record = append(record, text)
+				}
+			}
+			fill()
+			if err := emit(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}), nil
+}
+
+// PhoneNormalizer rewrites phone numbers to E.164, reading numbers without a
+// country code as numbers of region.
+type PhoneNormalizer struct {
+	columns string
+	region  string
+	onError fieldErrorPolicy
+}
+
+func newPhoneNormalizer(args map[string]string) (*PhoneNormalizer, error) {
+	t := PhoneNormalizer{columns: args["column"], region: strings.ToUpper(args["region"])}
+	if t.columns == "" {
+		return nil, fmt.Errorf("normalize-phone: column is required")
+	}
+	if t.region != "" && phonenumbers.GetCountryCodeForRegion(t.region) == 0 {
+		return nil, fmt.Errorf("normalize-phone: invalid region: %q", args["region"])
+	}
+	var err error
+	t.onError, err = newFieldErrorPolicy("normalize-phone", args)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (t PhoneNormalizer) normalize(s string) (string, error) {
+	n, err := phonenumbers.Parse(s, t.region)
+	if err != nil {
+		return "", err
+	}
+	if !phonenumbers.IsValidNumber(n) {
+		return "", fmt.Errorf("invalid phone number")
+	}
+	return phonenumbers.Format(n, phonenumbers.E164), nil
+}
+
+func (t PhoneNormalizer) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			indexes, err = columnIndexes(record, t.columns)
+			if err != nil {
+				return fmt.Errorf("normalize-phone: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			for _, i := range indexes {
+				if i >= len(record) || strings.TrimSpace(record[i]) == "" {
+					continue
+				}
+				v, err := t.normalize(record[i])
+				if err != nil {
+					if v, err = t.onError.handle("normalize-phone", record[i], err); err != nil {
+						return err
+					}
+				}
+				record[i] = v
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// RegexReplacer applies regexp.ReplaceAllString to the fields of columns, or
+// of every column. The replacement may refer to capture groups as $1 or ${name}.
+type RegexReplacer struct {
+	columns string
+	pattern *regexp.Regexp
+	replace string
+}
+
+func newRegexReplacer(args map[string]string) (*RegexReplacer, error) {
+	if args["pattern"] == "" {
+		return nil, fmt.Errorf("regexreplace: pattern is required")
+	}
+	pattern, err := regexp.Compile(args["pattern"])
+	if err != nil {
+		return nil, fmt.Errorf("regexreplace: invalid pattern: %v", err)
+	}
+	return &RegexReplacer{args["columns"], pattern, args["replace"]}, nil
+}
+
+func (t RegexReplacer) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			if t.columns == "" {
+				return emit(record)
+			}
+			indexes, err = columnIndexes(record, t.columns)
+			if err != nil {
+				return fmt.Errorf("regexreplace: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			if t.columns == "" {
+				for i := range record {
+					record[i] = t.pattern.ReplaceAllString(record[i], t.replace)
+				}
+				return emit(record)
+			}
+			for _, i := range indexes {
+				if i < len(record) {
+					record[i] = t.pattern.ReplaceAllString(record[i], t.replace)
+				}
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// NameSplitter splits a person's name into given and family name columns
+// appended to the row. "Last, First" is always split at the comma; otherwise
+// order says whether the family name comes last (first-last, e.g. English)
+// or first (last-first, e.g. Japanese).
+type NameSplitter struct {
+	column string
+	order  string
+	first  string
+	last   string
+}
+
+func newNameSplitter(args map[string]string) (*NameSplitter, error) {
+	t := NameSplitter{column: args["column"], order: args["format"], first: args["first"], last: args["last"]}
+	if t.column == "" {
+		return nil, fmt.Errorf("split-name: column is required")
+	}
+	switch t.order {
+	case "":
+		t.order = "first-last"
+	case "first-last", "last-first":
+	default:
+		return nil, fmt.Errorf("split-name: invalid format: %q", t.order)
+	}
+	if t.first == "" {
+		t.first = "first_name"
+	}
+	if t.last == "" {
+		t.last = "last_name"
+	}
+	return &t, nil
+}
+
+func (t NameSplitter) split(name string) (first string, last string) {
+	if l, f, ok := strings.Cut(name, ","); ok {
+		return strings.TrimSpace(f), strings.TrimSpace(l)
+	}
+	words := strings.Fields(name)
+	switch {
+	case len(words) == 0:
+		return "", ""
+	case len(words) == 1:
+		return words[0], ""
+	case t.order == "last-first":
+		return strings.Join(words[1:], " "), words[0]
+	default:
+		return strings.Join(words[:len(words)-1], " "), words[len(words)-1]
+	}
+}
+
+func (t NameSplitter) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var column int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			if column, err = columnIndex(record, t.column); err != nil {
+				return fmt.Errorf("split-name: %v", err)
+			}
+			return emit(append(record, t.first, t.last))
+		},
+		record: func(record []string, emit emitFunc) error {
+			first, last := t.split(field(record, column))
+			return emit(append(record, first, last))
+		},
+	}.edit(reader), nil
+}
+
+// ForceQuoter re-emits the CSV with every field quoted, which encoding/csv
+// only does for fields that need it.
+type ForceQuoter struct{}
+
+func (t ForceQuoter) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		defer reader.Close()
+		cr := csv.NewReader(reader)
+		cr.LazyQuotes = true
+		cr.FieldsPerRecord = -1
+		bw := bufio.NewWriter(pw)
+		pw.CloseWithError(func() error {
+			for {
+				record, err := cr.Read()
+				if err == io.EOF {
+					return bw.Flush()
+				}
+				if err != nil {
+					return err
+				}
+				for i, f := range record {
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					bw.WriteByte('"')
+					bw.WriteString(strings.ReplaceAll(f, `"`, `""`))
+					bw.WriteByte('"')
+				}
+				if _, err := bw.WriteString("\n"); err != nil {
+					return err
+				}
+			}
+		}())
+	}()
+	return pr, nil
+}
+
+// SpaceSqueezer collapses runs of Unicode whitespace inside fields to a single
+// space and trims both ends.
+type SpaceSqueezer struct {
+	columns string
+}
+
+func (t SpaceSqueezer) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	squeeze := func(s string) string { return strings.Join(strings.Fields(s), " ") }
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			if t.columns == "" {
+				return emit(record)
+			}
+			indexes, err = columnIndexes(record, t.columns)
+			if err != nil {
+				return fmt.Errorf("squeeze-space: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			if t.columns == "" {
+				for i := range record {
+					record[i] = squeeze(record[i])
+				}
+				return emit(record)
+			}
+			for _, i := range indexes {
+				if i < len(record) {
+					record[i] = squeeze(record[i])
+				}
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// UTCConverter parses timestamps with layout and rewrites them in UTC as
+// RFC3339. Timestamps without an offset are read in location.
+type UTCConverter struct {
+	columns  string
+	layout   string
+	location *time.Location
+	onError  fieldErrorPolicy
+}
+
+func newUTCConverter(args map[string]string) (*UTCConverter, error) {
+	t := UTCConverter{columns: args["column"], layout: args["layout"], location: time.UTC}
+	if t.columns == "" {
+		return nil, fmt.Errorf("to-utc: column is required")
+	}
+	if t.layout == "" {
+		t.layout = time.RFC3339
+	}
+	if v := args["timezone"]; v != "" {
+		var err error
+		if t.location, err = time.LoadLocation(v); err != nil {
+			return nil, fmt.Errorf("to-utc: invalid timezone: %q", v)
+		}
+	}
+	var err error
+	t.onError, err = newFieldErrorPolicy("to-utc", args)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (t UTCConverter) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			indexes, err = columnIndexes(record, t.columns)
+			if err != nil {
+				return fmt.Errorf("to-utc: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			for _, i := range indexes {
+				if i >= len(record) || record[i] == "" {
+					continue
+				}
+				d, err := time.ParseInLocation(t.layout, strings.TrimSpace(record[i]), t.location)
+				if err != nil {
+					if record[i], err = t.onError.handle("to-utc", record[i], err); err != nil {
+						return err
+					}
+					continue
+				}
+				record[i] = d.UTC().Format(time.RFC3339Nano)
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// EpochConverter rewrites Unix epoch numbers in unit, which may have a
+// fraction, as UTC RFC3339 timestamps or dates.
+type EpochConverter struct {
+	columns string
+	// unit is the number of nanoseconds in a unit of the epoch numbers.
+	unit    int64
+	layout  string
+	onError fieldErrorPolicy
+}
+
+func newEpochConverter(args map[string]string) (*EpochConverter, error) {
+	t := EpochConverter{columns: args["columns"]}
+	if t.columns == "" {
+		return nil, fmt.Errorf("epoch2datetime: columns is required")
+	}
+	switch args["unit"] {
+	case "", "s":
+		t.unit = int64(time.Second)
+	case "ms":
+		t.unit = int64(time.Millisecond)
+	case "us":
+		t.unit = int64(time.Microsecond)
+	default:
+		return nil, fmt.Errorf("epoch2datetime: invalid unit: %q", args["unit"])
+	}
+	switch args["to"] {
+	case "", "RFC3339":
+		t.layout = time.RFC3339Nano
+	case "date":
+		t.layout = "2006-01-02"
+	default:
+		return nil, fmt.Errorf("epoch2datetime: invalid to: %q", args["to"])
+	}
+	var err error
+	if t.onError, err = newFieldErrorPolicy("epoch2datetime", args); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (t EpochConverter) convert(s string) (string, error) {
+	n := strings.TrimSpace(s)
+	r, ok := new(big.Rat).SetString(n)
+	if !ok || !plainNumber.MatchString(n) {
+		return "", fmt.Errorf("invalid epoch: %q", s)
+	}
+	// Split into seconds and nanoseconds to avoid overflowing int64
+	// nanoseconds.
+	ns := new(big.Int).Quo(new(big.Int).Mul(r.Num(), big.NewInt(t.unit)), r.Denom())
+	sec, nsec := new(big.Int).DivMod(ns, big.NewInt(int64(time.Second)), new(big.Int))
+	if !sec.IsInt64() {
+		return "", fmt.Errorf("epoch out of range: %q", s)
+	}
+	d := time.Unix(sec.Int64(), nsec.Int64()).UTC()
+	if d.Year() < 1 || d.Year() > 9999 {
+		return "", fmt.Errorf("epoch out of range: %q", s)
+	}
+	return d.Format(t.layout), nil
+}
+
+func (t EpochConverter) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			indexes, err = columnIndexes(record, t.columns)
+			if err != nil {
+				return fmt.Errorf("epoch2datetime: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			for _, i := range indexes {
+				if i >= len(record) || strings.TrimSpace(record[i]) == "" {
+					continue
+				}
+				d, err := t.convert(record[i])
+				if err != nil {
+					if d, err = t.onError.handle("epoch2datetime", record[i], err); err != nil {
+						return err
+					}
+				}
+				record[i] = d
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// RowNumberer appends the number of each data row, counting from start.
+type RowNumberer struct {
+	name  string
+	start int64
+}
+
+func (t RowNumberer) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	n := t.start
+	return csvEditor{
+		header: func(record []string, emit emitFunc) error {
+			for _, h := range record {
+				if strings.EqualFold(h, t.name) {
+					return fmt.Errorf("rownum: column %q already exists", t.name)
+				}
+			}
+			return emit(append(record, t.name))
+		},
+		record: func(record []string, emit emitFunc) error {
+			record = append(record, strconv.FormatInt(n, 10))
+			n++
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// EmptyRowDropper removes data rows whose fields are all empty, or only
+// whitespace with trimSpace. With keepQuoted, rows written with quotes such
+// as "","" are kept.
+type EmptyRowDropper struct {
+	trimSpace  bool
+	keepQuoted bool
+}
+
+func (t EmptyRowDropper) empty(record []string) bool {
+	for _, f := range record {
+		if t.trimSpace {
+			f = strings.TrimSpace(f)
+		}
+		if f != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (t EmptyRowDropper) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	return writeCSV(reader, func(emit emitFunc) error {
+		// raw keeps the bytes read ahead by cr, to see how a record was written.
+		var raw bytes.Buffer
+		cr := csv.NewReader(io.TeeReader(reader, &raw))
+		cr.LazyQuotes = true
+		cr.FieldsPerRecord = -1
+		var offset int64
+		var dropped int
+		for i := 0; ; i++ {
+			record, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			line := raw.Next(int(cr.InputOffset() - offset))
+			offset = cr.InputOffset()
+			if i > 0 && t.empty(record) && !(t.keepQuoted && bytes.IndexByte(line, '"') >= 0) {
+				dropped++
+				continue
+			}
+			if err := emit(record); err != nil {
+				return err
+			}
+		}
+		log.Printf("drop-empty: dropped %d rows", dropped)
+		return nil
+	}), nil
+}
+
+// BooleanCoercer rewrites boolean-like values to true or false, comparing
+// them case-insensitively with the truthy and falsy values.
+type BooleanCoercer struct {
+	columns string
+	values  map[string]string
+	onError fieldErrorPolicy
+}
+
+func newBooleanCoercer(args map[string]string) (*BooleanCoercer, error) {
+	t := BooleanCoercer{columns: args["columns"], values: map[string]string{}}
+	if t.columns == "" {
+		return nil, fmt.Errorf("boolean: columns is required")
+	}
+	for value, list := range map[string]string{"true": args["truthy"], "false": args["falsy"]} {
+		if list == "" {
+			list = map[string]string{"true": "true,t,yes,y,1,on,はい", "false": "false,f,no,n,0,off,いいえ"}[value]
+		}
+		for _, s := range strings.Split(list, ",") {
+			s = strings.ToLower(strings.TrimSpace(s))
+			if v, ok := t.values[s]; ok && v != value {
+				return nil, fmt.Errorf("boolean: %q is both truthy and falsy", s)
+			}
+			t.values[s] = value
+		}
+	}
+	var err error
+	t.onError, err = newFieldErrorPolicy("boolean", args)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (t BooleanCoercer) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			indexes, err = columnIndexes(record, t.columns)
+			if err != nil {
+				return fmt.Errorf("boolean: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			for _, i := range indexes {
+				if i >= len(record) || strings.TrimSpace(record[i]) == "" {
+					continue
+				}
+				v, ok := t.values[strings.ToLower(strings.TrimSpace(record[i]))]
+				if !ok {
+					var err error
+					if v, err = t.onError.handle("boolean", record[i], fmt.Errorf("not a boolean: %q", record[i])); err != nil {
+						return err
+					}
+				}
+				record[i] = v
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// FieldTruncator cuts fields longer than max characters. The number of
+// truncated fields is logged.
+type FieldTruncator struct {
+	columns string
+	max     int
+}
+
+func (t FieldTruncator) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var indexes []int
+	var truncated int
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			if t.columns == "" {
+				indexes = make([]int, len(record))
+				for i := range record {
+					indexes[i] = i
+				}
+			} else if indexes, err = columnIndexes(record, t.columns); err != nil {
+				return fmt.Errorf("truncate-field: %v", err)
+			}
+			return emit(record)
+		},
+		record: func(record []string, emit emitFunc) error {
+			for _, i := range indexes {
+				if i >= len(record) || len(record[i]) <= t.max {
+					continue
+				}
+				if r := []rune(record[i]); len(r) > t.max {
+					record[i] = string(r[:t.max])
+					truncated++
+				}
+			}
+			return emit(record)
+		},
+		flush: func(emit emitFunc) error {
+			log.Printf("truncate-field: truncated %d fields", truncated)
+			return nil
+		},
+	}.edit(reader), nil
+}
+
+// HeaderReplacer discards the first skip records, a messy header, and emits
+// header in their place. The first data row must have as many fields.
+type HeaderReplacer struct {
+	header []string
+	skip   int
+}
+
+func newHeaderReplacer(args map[string]string) (*HeaderReplacer, error) {
+	t := HeaderReplacer{skip: 1}
+	var err error
+	if t.header, err = parseRow(args["header"]); err != nil || len(t.header) == 0 {
+		return nil, fmt.Errorf("replaceheader: invalid header: %q", args["header"])
+	}
+	if v := args["skip"]; v != "" {
+		if t.skip, err = strconv.Atoi(v); err != nil || t.skip < 0 {
+			return nil, fmt.Errorf("replaceheader: invalid skip: %q", v)
+		}
+	}
+	return &t, nil
+}
+
+func (t HeaderReplacer) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var n int
+	return csvEditor{
+		record: func(record []string, emit emitFunc) error {
+			n++
+			if n <= t.skip {
+				log.Printf("replaceheader: discarded %q", record)
+				return nil
+			}
+			if n == t.skip+1 {
+				if len(record) != len(t.header) {
+					return fmt.Errorf("replaceheader: header has %d columns, data has %d", len(t.header), len(record))
+				}
+				if err := emit(t.header); err != nil {
+					return err
+				}
+			}
+			return emit(record)
+		},
+		flush: func(emit emitFunc) error {
+			if n <= t.skip {
+				return emit(t.header)
+			}
+			return nil
+		},
+	}.edit(reader), nil
+}
+
+// cp1252Bytes maps the characters of Windows-1252 back to their bytes. Bytes
+// undefined in Windows-1252 map from the C1 control characters, as decoders
+// reading them as Latin-1 produce.
+var cp1252Bytes = func() map[rune]byte {
+	m := map[rune]byte{}
+	for b := 0x80; b <= 0xFF; b++ {
+		m[rune(b)] = byte(b)
+	}
+	for b := 0x80; b <= 0x9F; b++ {
+		if r := charmap.Windows1252.DecodeByte(byte(b)); r != utf8.RuneError {
+			m[r] = byte(b)
+		}
+	}
+	return m
+}()
+
+// fixMojibake reverses UTF-8 read as Windows-1252 or Latin-1, e.g. "ã‚«" to
+// "カ". s is returned unchanged unless every character maps back to a byte
+// and the bytes are valid UTF-8 with at least one multibyte character.
+func fixMojibake(s string) string {
+	b := make([]byte, 0, len(s))
+	multibyte := false
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			b = append(b, byte(r))
+			continue
+		}
+		c, ok := cp1252Bytes[r]
+		if !ok {
+			return s
+		}
+		multibyte = true
+		b = append(b, c)
+	}
+	if !multibyte || !utf8.Valid(b) {
+		return s
+	}
+	return string(b)
+}
+
+// MojibakeFixer repairs fields that fixMojibake confidently detects.
+type MojibakeFixer struct{}
+
+func (t MojibakeFixer) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	return csvEditor{
+		record: func(record []string, emit emitFunc) error {
+			for i := range record {
+				record[i] = fixMojibake(record[i])
+			}
+			return emit(record)
+		},
+	}.edit(reader), nil
+}
+
+// ColumnCoalescer replaces columns with a single column into, at the position
+// of the first of them, holding the first non-empty value of each row.
+type ColumnCoalescer struct {
+	columns string
+	into    string
+}
+
+func (t ColumnCoalescer) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	// indexes are in the order of columns, which is the order of precedence.
+	var indexes []int
+	var first, last int
+	drop := map[int]bool{}
+	coalesce := func(record []string, merged string) []string {
+		var out []string
+		for i, f := range record {
+			switch {
+			case i == first:
+				out = append(out, merged)
+			case !drop[i]:
+				out = append(out, f)
+			}
+		}
+		return out
+	}
+	return csvEditor{
+		header: func(record []string, emit emitFunc) (err error) {
+			if indexes, err = columnIndexes(record, t.columns); err != nil {
+				return fmt.Errorf("coalesce-columns: %v", err)
+			}
+			first, last = indexes[0], indexes[0]
+			for _, i := range indexes {
+				drop[i] = true
+				if i < first {
+					first = i
+				}
+				if i > last {
+					last = i
+				}
+			}
+			into := t.into
+			if into == "" {
+				into = record[indexes[0]]
+			}
+			return emit(coalesce(record, into))
+		},
+		record: func(record []string, emit emitFunc) error {
+			var merged string
+			for _, i := range indexes {
+				if v := field(record, i); v != "" {
+					merged = v
+					break
+				}
+			}
+			for len(record) <= last {
+				record = append(record, "")
+			}
+			return emit(coalesce(record, merged))
+		},
+	}.edit(reader), nil
+}
+
+// TypeCaster converts the CSV to newline delimited JSON, typing the columns
+// given in types; the other columns are strings. Empty fields are null.
+type TypeCaster struct {
+	types   map[string]string
+	onError fieldErrorPolicy
+}
+
+func newTypeCaster(args map[string]string) (*TypeCaster, error) {
+	t := TypeCaster{types: map[string]string{}}
+	for _, pair := range strings.Split(args["types"], ",") {
+		column, typ, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		typ = strings.ToUpper(typ)
+		switch typ {
+		case "STRING", "INTEGER", "INT64", "FLOAT", "FLOAT64", "NUMERIC", "BIGNUMERIC", "BOOLEAN", "BOOL":
+		default:
+			ok = false
+		}
+		if !ok {
+			return nil, fmt.Errorf("typecast: invalid types: %q", pair)
+		}
+		t.types[column] = typ
+	}
+	var err error
+	t.onError, err = newFieldErrorPolicy("typecast", args)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// cast returns the JSON value of s as typ.
+func (t TypeCaster) cast(s string, typ string) (json.RawMessage, error) {
+	if s == "" {
+		return json.RawMessage("null"), nil
+	}
+	switch typ {
+	case "INTEGER", "INT64":
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return json.RawMessage(strconv.FormatInt(n, 10)), nil
+	case "FLOAT", "FLOAT64":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(f)
+	case "NUMERIC", "BIGNUMERIC":
+		// Kept as written so that no precision is lost.
+		if _, ok := new(big.Rat).SetString(s); !ok || !json.Valid([]byte(s)) {
+			return nil, fmt.Errorf("invalid number: %q", s)
+		}
+		return json.RawMessage(s), nil
+	case "BOOLEAN", "BOOL":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(b)
+	}
+	return json.Marshal(s)
+}
+
+func (t TypeCaster) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		defer reader.Close()
+		cr := csv.NewReader(reader)
+		cr.LazyQuotes = true
+		cr.FieldsPerRecord = -1
+		bw := bufio.NewWriter(pw)
+		pw.CloseWithError(func() error {
+			header, err := cr.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			keys := make([][]byte, len(header))
+			types := make([]string, len(header))
+			for i, h := range header {
+				if keys[i], err = json.Marshal(h); err != nil {
+					return err
+				}
+				types[i] = t.types[h]
+			}
+			for c := range t.types {
+				if _, err := columnIndex(header, c); err != nil {
+					return fmt.Errorf("typecast: %v", err)
+				}
+			}
+			for {
+				record, err := cr.Read()
+				if err == io.EOF {
+					return bw.Flush()
+				}
+				if err != nil {
+					return err
+				}
+				bw.WriteByte('{')
+				for i, key := range keys {
+					v, err := t.cast(field(record, i), types[i])
+					if err != nil {
+						var s string
+						if s, err = t.onError.handle("typecast", field(record, i), err); err != nil {
+							return err
+						}
+						if v, err = t.cast(s, ""); err != nil {
+							return err
+						}
+					}
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					bw.Write(key)
+					bw.WriteByte(':')
+					bw.Write(v)
+				}
+				if _, err := bw.WriteString("}\n"); err != nil {
+					return err
+				}
+			}
+		}())
+	}()
+	return pr, nil
+}
+
+// DelimiterRepairer fixes lines of a CSV whose column text contains unquoted
+// commas. Lines with more than the header's fields are split at every comma,
+// and the surplus fields are joined back into column.
+type DelimiterRepairer struct {
+	column string
+}
+
+// csvLine formats record as a line of CSV without the line ending.
+func csvLine(record []string) (string, error) {
+	var b strings.Builder
+	cw := csv.NewWriter(&b)
+	if err := cw.Write(record); err != nil {
+		return "", err
+	}
+	cw.Flush()
+	return strings.TrimSuffix(b.String(), "\n"), cw.Error()
+}
+
+func (t DelimiterRepairer) tweak(reader io.ReadCloser) (io.ReadCloser, error) {
+	var n, column int
+	header := true
+	return editLines(reader, func(line string) (string, error) {
+		if header {
+			header = false
+			cr := csv.NewReader(strings.NewReader(line))
+			cr.LazyQuotes = true
+			record, err := cr.Read()
+			if err != nil {
+				return "", fmt.Errorf("repair-delimiter: %v", err)
+			}
+			if column, err = columnIndex(record, t.column); err != nil {
+				return "", fmt.Errorf("repair-delimiter: %v", err)
+			}
+			n = len(record)
+			return line, nil
+		}
+		// Lines with quotes are left to the CSV reader.
+		if strings.Contains(line, `"`) {
+			return line, nil
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) <= n {
+			return line, nil
+		}
+		extra := len(fields) - n
+		record := append([]string{}, fields[:column]...)
+		record = append(record, strings.Join(fields[column:column+extra+1], ","))
+		record = append(record, fields[column+extra+1:]...)
+		return csvLine(record)
+	}), nil
+}
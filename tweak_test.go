@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDedupNames(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  []string
+	}{
+		{[]string{"id", "amount"}, []string{"id", "amount"}},
+		{[]string{"amount", "amount"}, []string{"amount", "amount_1"}},
+		{[]string{"amount", "Amount", "AMOUNT"}, []string{"amount", "Amount_1", "AMOUNT_2"}},
+		{[]string{"a b", "a-b", "a_b"}, []string{"a b", "a-b_1", "a_b_2"}},
+		{[]string{"amount", "amount", "amount_1"}, []string{"amount", "amount_2", "amount_1"}},
+		{[]string{"1st", "_1st"}, []string{"1st", "_1st_1"}},
+	}
+	for _, tt := range tests {
+		if got := dedupNames(tt.names); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("dedupNames(%q) = %q, want %q", tt.names, got, tt.want)
+		}
+		seen := map[string]bool{}
+		for _, name := range dedupNames(tt.names) {
+			key := strings.ToLower(sanitizeColumnName(name))
+			if seen[key] {
+				t.Errorf("dedupNames(%q): duplicate sanitized name %q", tt.names, key)
+			}
+			seen[key] = true
+		}
+	}
+}
+
+func TestHeaderDeduplicator(t *testing.T) {
+	r, err := HeaderDeduplicator{}.tweak(io.NopCloser(strings.NewReader("amount,Amount,a b,a-b\n1,2,3,4\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "amount,Amount_1,a b,a-b_1\n1,2,3,4\n"; string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
+
+func openFiles(t *testing.T) int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip(err)
+	}
+	return len(fds)
+}
+
+func TestRowSorterSpill(t *testing.T) {
+	defer func(budget int64) { memoryBudget = budget }(memoryBudget)
+	memoryBudget = 100
+	var in, want strings.Builder
+	in.WriteString("k\n")
+	want.WriteString("k\n")
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&in, "%02d\n", 49-i)
+		fmt.Fprintf(&want, "%02d\n", i)
+	}
+	sorter, err := newRowSorter(map[string]string{"by": "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := sorter.tweak(io.NopCloser(strings.NewReader(in.String())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want.String() {
+		t.Errorf("got %q, want %q", b, want.String())
+	}
+}
+
+func TestRowSorterSpillError(t *testing.T) {
+	defer func(budget int64) { memoryBudget = budget }(memoryBudget)
+	memoryBudget = 100
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	before := openFiles(t)
+
+	in := io.MultiReader(strings.NewReader("k\n"+strings.Repeat("value\n", 50)), iotest.ErrReader(errors.New("broken")))
+	sorter, err := newRowSorter(map[string]string{"by": "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := sorter.tweak(io.NopCloser(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatal("want the input error")
+	}
+	if after := openFiles(t); after > before {
+		t.Errorf("%d files left open", after-before)
+	}
+	if files, _ := os.ReadDir(dir); len(files) > 0 {
+		t.Errorf("%d temporary files left", len(files))
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	tests := []struct {
+		agg  string
+		in   string
+		want string
+		ok   bool
+	}{
+		{"v:sum", "k,v\na,1\na,2.5\nb,\n", "k,v\na,3.5\nb,\n", true},
+		{"v:max", "k,v\na,1\na,-2\n", "k,v\na,1\n", true},
+		{"v:sum", "k,v\na,1/3\n", "", false},
+		{"v:min", "k,v\na,1\na,2/3\n", "", false},
+		{"v:sum", "k,v\na,1e3\n", "", false},
+	}
+	for _, tt := range tests {
+		a, err := newAggregator(map[string]string{"keys": "k", "agg": tt.agg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := a.tweak(io.NopCloser(strings.NewReader(tt.in)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if (err == nil) != tt.ok {
+			t.Errorf("aggregate %s of %q: error = %v, want ok %v", tt.agg, tt.in, err, tt.ok)
+		} else if tt.ok && string(b) != tt.want {
+			t.Errorf("aggregate %s of %q = %q, want %q", tt.agg, tt.in, b, tt.want)
+		}
+	}
+}